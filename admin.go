@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type adminCfg struct {
+	Listen string
+}
+
+// admin serves the HTTP API to inspect and manipulate the cache
+type admin struct {
+	c      *cache
+	lists  domainLists
+	add    addFunc
+	drop   expireFunc
+	ttlPol *ttlPolicy
+}
+
+func newAdmin(cf *adminCfg, c *cache, lists domainLists, add addFunc, drop expireFunc, ttlPol *ttlPolicy) (a *admin, err error) {
+	if cf.Listen == "" {
+		return nil, fmt.Errorf("you need to specify admin API listening point")
+	}
+
+	a = &admin{
+		c:      c,
+		lists:  lists,
+		add:    add,
+		drop:   drop,
+		ttlPol: ttlPol,
+	}
+
+	l, err := net.Listen("tcp", cf.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ip", a.handleIP)
+	mux.HandleFunc("/domain", a.handleDomain)
+	mux.HandleFunc("/expire", a.handleExpire)
+	mux.HandleFunc("/add", a.handleAdd)
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	return
+}
+
+func badRequest(wr http.ResponseWriter, f string, args ...interface{}) {
+	wr.WriteHeader(400)
+	fmt.Fprintf(wr, "Bad request: "+f, args...)
+}
+
+func writeEntries(wr http.ResponseWriter, es []*cacheEntry) {
+	if es == nil {
+		es = []*cacheEntry{}
+	}
+
+	sort.Slice(es, func(i, j int) bool {
+		if c := strings.Compare(es[i].IP.String(), es[j].IP.String()); c != 0 {
+			return c < 0
+		}
+
+		return es[i].Domain < es[j].Domain
+	})
+
+	wr.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(wr).Encode(es)
+}
+
+// handleIP returns the domains referencing the IP: GET /ip?ip=1.2.3.4
+func (a *admin) handleIP(wr http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		wr.WriteHeader(400)
+		return
+	}
+
+	ip := net.ParseIP(r.FormValue("ip"))
+	if ip == nil {
+		badRequest(wr, "unable to parse IP '%s'", r.FormValue("ip"))
+		return
+	}
+
+	writeEntries(wr, a.c.get(ip))
+}
+
+// handleDomain returns the IPs of the domain or of its subdomains too if subtree is set:
+// GET /domain?name=foo.com&subtree=true
+func (a *admin) handleDomain(wr http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		wr.WriteHeader(400)
+		return
+	}
+
+	name := strings.ToLower(r.FormValue("name"))
+	if name == "" {
+		badRequest(wr, "no domain name specified")
+		return
+	}
+
+	subtree := r.FormValue("subtree") == "true"
+
+	es := []*cacheEntry{}
+	for _, e := range a.c.getAll() {
+		d := strings.ToLower(e.Domain)
+		if d == name || (subtree && strings.HasSuffix(d, "."+name)) {
+			es = append(es, e)
+		}
+	}
+
+	writeEntries(wr, es)
+}
+
+// handleExpire removes the references of the IP, only of the domain if it's given,
+// and withdraws the IP if none are left: POST /expire?ip=1.2.3.4&domain=foo.com
+func (a *admin) handleExpire(wr http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		wr.WriteHeader(400)
+		return
+	}
+
+	ip := net.ParseIP(r.FormValue("ip"))
+	if ip == nil {
+		badRequest(wr, "unable to parse IP '%s'", r.FormValue("ip"))
+		return
+	}
+
+	domain := r.FormValue("domain")
+
+	es := []*cacheEntry{}
+	a.c.purge(func(e *cacheEntry) bool {
+		return e.IP.Equal(ip) && (domain == "" || e.Domain == domain)
+	}, func(e, next *cacheEntry) {
+		log.Printf("Admin: %s (%s) expired, withdrawn: %t", e.IP, e.Domain, next == nil)
+		a.drop(e, next)
+		es = append(es, e)
+	})
+
+	writeEntries(wr, es)
+}
+
+// handleAdd adds a manual entry, the lifetime defaults to the cache TTL:
+// POST /add?ip=1.2.3.4&domain=foo.com&lifetime=1h&list=video&tag=site1, the list is checked if specified
+func (a *admin) handleAdd(wr http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		wr.WriteHeader(400)
+		return
+	}
+
+	ip := net.ParseIP(r.FormValue("ip"))
+	if ip == nil {
+		badRequest(wr, "unable to parse IP '%s'", r.FormValue("ip"))
+		return
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	domain := r.FormValue("domain")
+	if domain == "" {
+		badRequest(wr, "no domain name specified")
+		return
+	}
+
+	lifetime := a.ttlPol.fixed
+	if v := r.FormValue("lifetime"); v != "" {
+		var err error
+		if lifetime, err = time.ParseDuration(v); err != nil || lifetime <= 0 {
+			badRequest(wr, "unable to parse lifetime '%s'", v)
+			return
+		}
+	}
+
+	// The entry should match the lists like the DNS replies do, otherwise it would be dropped
+	// on the next reload or restart and rejected by the peers checking the lists
+	tag := r.FormValue("tag")
+	list, ok := a.lists.match(domain, tag)
+	if !ok {
+		badRequest(wr, "domain '%s' doesn't match any list", domain)
+		return
+	}
+
+	if v, set := r.Form["list"]; set && v[0] != list {
+		badRequest(wr, "domain '%s' matches list '%s', not '%s'", domain, list, v[0])
+		return
+	}
+
+	now := time.Now()
+	e := &cacheEntry{
+		IP:      ip,
+		Domain:  domain,
+		List:    list,
+		Chain:   []string{domain},
+		Source:  "manual",
+		Tag:     tag,
+		TS:      now,
+		Expires: now.Add(lifetime),
+	}
+
+	a.add(e, true)
+	writeEntries(wr, a.c.get(ip))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Admin(t *testing.T) {
+	c := newCache(time.Hour, nil, nil)
+	now := time.Now()
+
+	for _, e := range []*cacheEntry{
+		{IP: net.ParseIP("1.2.3.4"), Domain: "foo.bar", TS: now},
+		{IP: net.ParseIP("1.2.3.4"), Domain: "api.foo.bar", TS: now},
+		{IP: net.ParseIP("4.3.2.1"), Domain: "bar.foo", TS: now},
+	} {
+		c.add(e)
+	}
+
+	add := func(e *cacheEntry, touch bool) bool {
+		return c.add(e)
+	}
+
+	dropped := []*cacheEntry{}
+	drop := func(e, next *cacheEntry) {
+		dropped = append(dropped, e)
+	}
+
+	dl := domainLists{}.add("", "").add("video", "")
+	dl[0].t.loadList([]string{"foo.manual"})
+	dl[1].t.loadList([]string{"bar.video"})
+
+	port := rand.Intn(60000) + 2000
+	url := fmt.Sprintf("http://127.0.0.1:%d", port)
+	_, err := newAdmin(&adminCfg{
+		Listen: fmt.Sprintf("127.0.0.1:%d", port),
+	}, c, dl, add, drop, &ttlPolicy{fixed: time.Hour})
+	assert.Nil(t, err)
+
+	call := func(method, path string) (code int, es []*cacheEntry) {
+		req, err := http.NewRequest(method, url+path, nil)
+		assert.Nil(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+
+		if resp.StatusCode == 200 {
+			assert.Nil(t, json.NewDecoder(resp.Body).Decode(&es))
+		}
+
+		return resp.StatusCode, es
+	}
+
+	code, es := call("GET", "/ip?ip=1.2.3.4")
+	assert.Equal(t, 200, code)
+	assert.Len(t, es, 2)
+	assert.Equal(t, "api.foo.bar", es[0].Domain)
+
+	code, _ = call("GET", "/ip?ip=foo")
+	assert.Equal(t, 400, code)
+
+	_, es = call("GET", "/domain?name=foo.bar")
+	assert.Len(t, es, 1)
+
+	_, es = call("GET", "/domain?name=foo.bar&subtree=true")
+	assert.Len(t, es, 2)
+
+	code, es = call("POST", "/expire?ip=1.2.3.4&domain=api.foo.bar")
+	assert.Equal(t, 200, code)
+	assert.Len(t, es, 1)
+	assert.Len(t, dropped, 1)
+	assert.False(t, cached(c, net.ParseIP("1.2.3.4"), "api.foo.bar"))
+	assert.True(t, cached(c, net.ParseIP("1.2.3.4"), "foo.bar"))
+
+	code, _ = call("POST", "/add?ip=5.6.7.8&domain=other.foo")
+	assert.Equal(t, 400, code)
+
+	// The domain doesn't match the list
+	code, _ = call("POST", "/add?ip=5.6.7.8&domain=manual.foo&list=video")
+	assert.Equal(t, 400, code)
+
+	code, es = call("POST", "/add?ip=5.6.7.8&domain=manual.foo&list=&lifetime=5m")
+	assert.Equal(t, 200, code)
+	assert.Len(t, es, 1)
+	assert.Equal(t, "manual", es[0].Source)
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), es[0].Expires, time.Minute)
+
+	// The list is found by the domain
+	code, es = call("POST", "/add?ip=5.6.7.9&domain=cdn.video.bar")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "video", es[0].List)
+}
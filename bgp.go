@@ -20,14 +20,81 @@ type bgpCfg struct {
 	NextHop     string
 	NextHopIPv6 string
 	SourceIP    string
+	bgpCommunities
 
+	// Legacy "host[:port]" form, they're added to the ones in Peer
+	Peers    []string
+	Peer     []*bgpPeerCfg
+	IPv6     bool
+	Policies map[string]*bgpPolicy `toml:"-"`
+}
+
+type bgpPeerCfg struct {
+	Address     string
+	Port        int
+	Description string
+
+	// Peer AS, if not set - the local AS is used (iBGP)
+	AS       uint32
+	Password string
+	SourceIP string
+	Multihop uint32
+
+	// Timers in time.Duration format, rounded down to seconds
+	ConnectRetry string
+	HoldTime     string
+	Keepalive    string
+
+	// "ipv4" and/or "ipv6", both if empty
+	Families []string
+}
+
+var bgpFamilies = map[string]api.Family_Afi{
+	"ipv4": api.Family_AFI_IP,
+	"ipv6": api.Family_AFI_IP6,
+}
+
+// bgpPolicy overrides the global announcement settings for a domain list,
+// its communities are added to the global ones
+type bgpPolicy struct {
+	NextHop     string
+	NextHopIPv6 string
+	bgpCommunities
+
+	// Neighbor addresses to announce to, all peers if empty
 	Peers []string
-	IPv6  bool
 }
 
 type bgpServer struct {
 	s *gobgp.BgpServer
 	c *bgpCfg
+
+	// Extra path attributes per list
+	attrs map[string][]*any.Any
+
+	// The peers are added on start so that the sessions come up with all paths in place
+	peers []*api.Peer
+}
+
+func policySetName(list string, ipv6 bool) string {
+	if ipv6 {
+		return "list-" + list + "-v6"
+	}
+
+	return "list-" + list + "-v4"
+}
+
+func hostPrefix(ip net.IP) *api.Prefix {
+	var l uint32 = 32
+	if ip.To4() == nil {
+		l = 128
+	}
+
+	return &api.Prefix{
+		IpPrefix:      fmt.Sprintf("%s/%d", ip, l),
+		MaskLengthMin: l,
+		MaskLengthMax: l,
+	}
 }
 
 func newBgp(c *bgpCfg) (b *bgpServer, err error) {
@@ -35,14 +102,26 @@ func newBgp(c *bgpCfg) (b *bgpServer, err error) {
 		return nil, fmt.Errorf("you need to provide AS")
 	}
 
-	if len(c.Peers) == 0 {
+	if len(c.Peers) == 0 && len(c.Peer) == 0 {
 		return nil, fmt.Errorf("you need to provide at least one peer")
 	}
 
 	b = &bgpServer{
-		s: gobgp.NewBgpServer(),
-		c: c,
+		s:     gobgp.NewBgpServer(),
+		c:     c,
+		attrs: map[string][]*any.Any{},
+	}
+
+	if b.attrs[""], err = communityAttrs(&c.bgpCommunities); err != nil {
+		return nil, err
+	}
+
+	for name, p := range c.Policies {
+		if b.attrs[name], err = communityAttrs(&c.bgpCommunities, &p.bgpCommunities); err != nil {
+			return nil, fmt.Errorf("list '%s': %w", name, err)
+		}
 	}
+
 	go b.s.Serve()
 
 	if err = b.s.StartBgp(context.Background(), &api.StartBgpRequest{
@@ -55,51 +134,199 @@ func newBgp(c *bgpCfg) (b *bgpServer, err error) {
 		return
 	}
 
-	for _, p := range c.Peers {
-		if err = b.addPeer(p); err != nil {
-			return
+	peers := c.Peer
+	for _, addr := range c.Peers {
+		p, err := parsePeer(addr)
+		if err != nil {
+			return nil, err
 		}
+
+		peers = append(peers, p)
+	}
+
+	for _, pc := range peers {
+		p, err := b.peerConf(pc)
+		if err != nil {
+			return nil, err
+		}
+
+		b.peers = append(b.peers, p)
+	}
+
+	if err = b.addPolicies(); err != nil {
+		return nil, fmt.Errorf("unable to add policies: %w", err)
 	}
 
 	return
 }
 
-func (b *bgpServer) addPeer(addr string) (err error) {
-	port := 179
+// addPolicies installs a global export policy which rejects the paths of a list
+// towards the neighbors that are not among the list's peers.
+// The paths of a list are tracked in a per-family prefix set.
+func (b *bgpServer) addPolicies() (err error) {
+	ctx := context.Background()
+	stmts := []*api.Statement{}
 
-	if t := strings.SplitN(addr, ":", 2); len(t) == 2 {
-		addr = t[0]
+	for name, p := range b.c.Policies {
+		if len(p.Peers) == 0 {
+			continue
+		}
 
-		if port, err = strconv.Atoi(t[1]); err != nil {
-			return fmt.Errorf("unable to parse port '%s' as int: %s", t[1], err)
+		nbrs := []string{}
+		for _, n := range p.Peers {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return fmt.Errorf("list '%s': unable to parse peer '%s' as IP", name, n)
+			}
+
+			nbrs = append(nbrs, hostPrefix(ip).IpPrefix)
 		}
-	}
 
-	p := &api.Peer{
-		Conf: &api.PeerConf{
-			NeighborAddress: addr,
-			PeerAsn:         b.c.AS,
-		},
+		nbrSet := "list-" + name + "-peers"
+		if err = b.s.AddDefinedSet(ctx, &api.AddDefinedSetRequest{
+			DefinedSet: &api.DefinedSet{
+				DefinedType: api.DefinedType_NEIGHBOR,
+				Name:        nbrSet,
+				List:        nbrs,
+			},
+		}); err != nil {
+			return
+		}
 
-		AfiSafis: []*api.AfiSafi{
-			{
-				Config: &api.AfiSafiConfig{
-					Family: &api.Family{
-						Afi:  api.Family_AFI_IP,
-						Safi: api.Family_SAFI_UNICAST,
-					},
-					Enabled: true,
+		for _, v6 := range []bool{false, true} {
+			pfxSet := policySetName(name, v6)
+			if err = b.s.AddDefinedSet(ctx, &api.AddDefinedSetRequest{
+				DefinedSet: &api.DefinedSet{
+					DefinedType: api.DefinedType_PREFIX,
+					Name:        pfxSet,
 				},
-			},
-			{
-				Config: &api.AfiSafiConfig{
-					Family: &api.Family{
-						Afi:  api.Family_AFI_IP6,
-						Safi: api.Family_SAFI_UNICAST,
+			}); err != nil {
+				return
+			}
+
+			stmts = append(stmts, &api.Statement{
+				Name: pfxSet,
+				Conditions: &api.Conditions{
+					PrefixSet: &api.MatchSet{
+						Type: api.MatchSet_ANY,
+						Name: pfxSet,
+					},
+					NeighborSet: &api.MatchSet{
+						Type: api.MatchSet_INVERT,
+						Name: nbrSet,
 					},
-					Enabled: true,
 				},
-			},
+				Actions: &api.Actions{
+					RouteAction: api.RouteAction_REJECT,
+				},
+			})
+		}
+	}
+
+	if len(stmts) == 0 {
+		return
+	}
+
+	pol := &api.Policy{
+		Name:       "lists",
+		Statements: stmts,
+	}
+
+	if err = b.s.AddPolicy(ctx, &api.AddPolicyRequest{
+		Policy: pol,
+	}); err != nil {
+		return
+	}
+
+	return b.s.AddPolicyAssignment(ctx, &api.AddPolicyAssignmentRequest{
+		Assignment: &api.PolicyAssignment{
+			Name:          "global",
+			Direction:     api.PolicyDirection_EXPORT,
+			Policies:      []*api.Policy{pol},
+			DefaultAction: api.RouteAction_ACCEPT,
+		},
+	})
+}
+
+// setPolicyPrefix adds or removes the host prefix to the list's prefix set
+func (b *bgpServer) setPolicyPrefix(ip net.IP, list string, add bool) (err error) {
+	p := b.c.Policies[list]
+	if p == nil || len(p.Peers) == 0 {
+		return
+	}
+
+	ds := &api.DefinedSet{
+		DefinedType: api.DefinedType_PREFIX,
+		Name:        policySetName(list, ip.To4() == nil),
+		Prefixes:    []*api.Prefix{hostPrefix(ip)},
+	}
+
+	if add {
+		return b.s.AddDefinedSet(context.Background(), &api.AddDefinedSetRequest{
+			DefinedSet: ds,
+		})
+	}
+
+	return b.s.DeleteDefinedSet(context.Background(), &api.DeleteDefinedSetRequest{
+		DefinedSet: ds,
+	})
+}
+
+// parsePeer converts the legacy "host[:port]" peer form into a peer config
+func parsePeer(addr string) (p *bgpPeerCfg, err error) {
+	p = &bgpPeerCfg{
+		Address: addr,
+	}
+
+	if h, port, err := net.SplitHostPort(addr); err == nil {
+		p.Address = h
+
+		if p.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("unable to parse port '%s' as int: %s", port, err)
+		}
+	}
+
+	return
+}
+
+func parseTimer(s string) (v uint64, err error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return
+	}
+
+	return uint64(d / time.Second), nil
+}
+
+func (b *bgpServer) peerConf(pc *bgpPeerCfg) (p *api.Peer, err error) {
+	if pc.Address == "" {
+		return nil, fmt.Errorf("you need to provide peer address")
+	}
+
+	port, as, src := pc.Port, pc.AS, pc.SourceIP
+	if port == 0 {
+		port = 179
+	}
+
+	if as == 0 {
+		as = b.c.AS
+	}
+
+	if src == "" {
+		src = b.c.SourceIP
+	}
+
+	families := pc.Families
+	if len(families) == 0 {
+		families = []string{"ipv4", "ipv6"}
+	}
+
+	p = &api.Peer{
+		Conf: &api.PeerConf{
+			NeighborAddress: pc.Address,
+			PeerAsn:         as,
+			AuthPassword:    pc.Password,
+			Description:     pc.Description,
 		},
 
 		Timers: &api.Timers{
@@ -110,23 +337,79 @@ func (b *bgpServer) addPeer(addr string) (err error) {
 
 		Transport: &api.Transport{
 			MtuDiscovery:  true,
-			RemoteAddress: addr,
+			RemoteAddress: pc.Address,
 			RemotePort:    uint32(port),
+			LocalAddress:  src,
 		},
 	}
 
-	if b.c.SourceIP != "" {
-		p.Transport.LocalAddress = b.c.SourceIP
+	for _, f := range families {
+		afi, ok := bgpFamilies[strings.ToLower(f)]
+		if !ok {
+			return nil, fmt.Errorf("peer %s: unknown address family '%s'", pc.Address, f)
+		}
+
+		p.AfiSafis = append(p.AfiSafis, &api.AfiSafi{
+			Config: &api.AfiSafiConfig{
+				Family: &api.Family{
+					Afi:  afi,
+					Safi: api.Family_SAFI_UNICAST,
+				},
+				Enabled: true,
+			},
+		})
+	}
+
+	tc := p.Timers.Config
+	for _, t := range []struct {
+		s string
+		v *uint64
+	}{
+		{pc.ConnectRetry, &tc.ConnectRetry},
+		{pc.HoldTime, &tc.HoldTime},
+		{pc.Keepalive, &tc.KeepaliveInterval},
+	} {
+		if t.s == "" {
+			continue
+		}
+
+		if *t.v, err = parseTimer(t.s); err != nil {
+			return nil, fmt.Errorf("peer %s: unable to parse timer: %w", pc.Address, err)
+		}
 	}
 
-	return b.s.AddPeer(context.Background(), &api.AddPeerRequest{
-		Peer: p,
-	})
+	if pc.Multihop > 0 {
+		p.EbgpMultihop = &api.EbgpMultihop{
+			Enabled:     true,
+			MultihopTtl: pc.Multihop,
+		}
+	}
+
+	return
 }
 
-func (b *bgpServer) getPath(ip net.IP) *api.Path {
+// start adds the peers, the paths added before are announced as soon as the sessions are up
+func (b *bgpServer) start() (err error) {
+	for _, p := range b.peers {
+		if err = b.s.AddPeer(context.Background(), &api.AddPeerRequest{
+			Peer: p,
+		}); err != nil {
+			return fmt.Errorf("unable to add peer %s: %w", p.Conf.NeighborAddress, err)
+		}
+	}
+
+	return
+}
+
+func (b *bgpServer) getPath(ip net.IP, list string) *api.Path {
 	var nh string
 	var pfxLen uint32 = 32
+
+	pol, attrs := b.c.Policies[list], b.attrs[list]
+	if pol == nil {
+		pol, attrs = &bgpPolicy{}, b.attrs[""]
+	}
+
 	if ip.To4() == nil {
 		if !b.c.IPv6 {
 			return nil
@@ -149,7 +432,9 @@ func (b *bgpServer) getPath(ip net.IP) *api.Path {
 			Safi: api.Family_SAFI_UNICAST,
 		}
 
-		if b.c.NextHopIPv6 != "" {
+		if pol.NextHopIPv6 != "" {
+			nh = pol.NextHopIPv6
+		} else if b.c.NextHopIPv6 != "" {
 			nh = b.c.NextHopIPv6
 		} else {
 			nh = "fd00::1"
@@ -164,10 +449,12 @@ func (b *bgpServer) getPath(ip net.IP) *api.Path {
 		return &api.Path{
 			Family: v6Family,
 			Nlri:   nlri,
-			Pattrs: []*any.Any{a1, v6Attrs},
+			Pattrs: append([]*any.Any{a1, v6Attrs}, attrs...),
 		}
 	} else {
-		if b.c.NextHop != "" {
+		if pol.NextHop != "" {
+			nh = pol.NextHop
+		} else if b.c.NextHop != "" {
 			nh = b.c.NextHop
 		} else if b.c.SourceIP != "" {
 			nh = b.c.SourceIP
@@ -185,17 +472,27 @@ func (b *bgpServer) getPath(ip net.IP) *api.Path {
 				Safi: api.Family_SAFI_UNICAST,
 			},
 			Nlri:   nlri,
-			Pattrs: []*any.Any{a1, a2},
+			Pattrs: append([]*any.Any{a1, a2}, attrs...),
 		}
 	}
 }
 
-func (b *bgpServer) addHost(ip net.IP) (err error) {
-	p := b.getPath(ip)
+func (b *bgpServer) addHost(ip net.IP, list string) (err error) {
+	defer func() {
+		if err != nil {
+			mBGPErrors.WithLabelValues("add").Inc()
+		}
+	}()
+
+	p := b.getPath(ip, list)
 	if p == nil {
 		return
 	}
 
+	if err = b.setPolicyPrefix(ip, list, true); err != nil {
+		return
+	}
+
 	_, err = b.s.AddPath(context.Background(), &api.AddPathRequest{
 		Path: p,
 	})
@@ -203,15 +500,34 @@ func (b *bgpServer) addHost(ip net.IP) (err error) {
 	return
 }
 
-func (b *bgpServer) delHost(ip net.IP) (err error) {
-	p := b.getPath(ip)
+func (b *bgpServer) delHost(ip net.IP, list string) (err error) {
+	defer func() {
+		if err != nil {
+			mBGPErrors.WithLabelValues("delete").Inc()
+		}
+	}()
+
+	p := b.getPath(ip, list)
 	if p == nil {
 		return
 	}
 
-	return b.s.DeletePath(context.Background(), &api.DeletePathRequest{
+	if err = b.s.DeletePath(context.Background(), &api.DeletePathRequest{
 		Path: p,
-	})
+	}); err != nil {
+		return
+	}
+
+	return b.setPolicyPrefix(ip, list, false)
+}
+
+// moveHost re-announces the host with the policy of another list
+func (b *bgpServer) moveHost(ip net.IP, from, to string) (err error) {
+	if err = b.setPolicyPrefix(ip, from, false); err != nil {
+		return
+	}
+
+	return b.addHost(ip, to)
 }
 
 func (b *bgpServer) close() error {
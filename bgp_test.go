@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"math/rand"
 	"net"
+	"sort"
 	"testing"
+	"time"
 
+	api "github.com/osrg/gobgp/v3/api"
+	gobgp "github.com/osrg/gobgp/v3/pkg/server"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_BGP(t *testing.T) {
@@ -17,12 +24,237 @@ func Test_BGP(t *testing.T) {
 	})
 
 	assert.Nil(t, err)
-	err = b.addHost(net.ParseIP("1.2.3.4"))
+	err = b.addHost(net.ParseIP("1.2.3.4"), "")
 	assert.Nil(t, err)
 
-	err = b.delHost(net.ParseIP("1.2.3.4"))
+	err = b.delHost(net.ParseIP("1.2.3.4"), "")
 	assert.Nil(t, err)
 
 	err = b.close()
 	assert.Nil(t, err)
 }
+
+func Test_BGPPolicies(t *testing.T) {
+	b, err := newBgp(&bgpCfg{
+		AS:       65000,
+		RouterID: "127.0.0.1",
+		NextHop:  "127.0.0.1",
+		IPv6:     true,
+		Peers: []string{
+			"127.0.0.1",
+		},
+		Policies: map[string]*bgpPolicy{
+			"video": {
+				NextHop:     "10.0.0.1",
+				NextHopIPv6: "fd00::2",
+				Peers:       []string{"127.0.0.2"},
+				bgpCommunities: bgpCommunities{
+					Communities: []string{"65000:100"},
+				},
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	assert.Contains(t, b.getPath(net.ParseIP("1.2.3.4"), "").String(), "127.0.0.1")
+	assert.Len(t, b.getPath(net.ParseIP("1.2.3.4"), "").Pattrs, 2)
+	assert.Contains(t, b.getPath(net.ParseIP("1.2.3.4"), "video").String(), "10.0.0.1")
+	assert.Len(t, b.getPath(net.ParseIP("1.2.3.4"), "video").Pattrs, 3)
+	assert.Contains(t, b.getPath(net.ParseIP("2a00::1"), "video").String(), "fd00::2")
+
+	for _, ip := range []string{"1.2.3.4", "2a00::1"} {
+		err = b.addHost(net.ParseIP(ip), "video")
+		assert.Nil(t, err)
+
+		err = b.delHost(net.ParseIP(ip), "video")
+		assert.Nil(t, err)
+	}
+
+	err = b.close()
+	assert.Nil(t, err)
+}
+
+func Test_parsePeer(t *testing.T) {
+	p, err := parsePeer("192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, &bgpPeerCfg{Address: "192.168.0.1"}, p)
+
+	p, err = parsePeer("192.168.0.2:177")
+	assert.Nil(t, err)
+	assert.Equal(t, &bgpPeerCfg{Address: "192.168.0.2", Port: 177}, p)
+
+	p, err = parsePeer("[fd00::1]:179")
+	assert.Nil(t, err)
+	assert.Equal(t, &bgpPeerCfg{Address: "fd00::1", Port: 179}, p)
+
+	p, err = parsePeer("fd00::1")
+	assert.Nil(t, err)
+	assert.Equal(t, &bgpPeerCfg{Address: "fd00::1"}, p)
+}
+
+func Test_BGPPeers(t *testing.T) {
+	b, err := newBgp(&bgpCfg{
+		AS:       65000,
+		RouterID: "127.0.0.1",
+		Peers: []string{
+			"127.0.0.1",
+		},
+		Peer: []*bgpPeerCfg{
+			{
+				Address:  "127.0.0.2",
+				Port:     1179,
+				AS:       65001,
+				Password: "secret",
+				Multihop: 3,
+				HoldTime: "30s",
+				Families: []string{"ipv4"},
+			},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, b.start())
+
+	var peers []*api.Peer
+	err = b.s.ListPeer(context.Background(), &api.ListPeerRequest{}, func(p *api.Peer) {
+		peers = append(peers, p)
+	})
+	assert.Nil(t, err)
+	assert.Len(t, peers, 2)
+
+	for _, p := range peers {
+		if p.Conf.NeighborAddress != "127.0.0.2" {
+			assert.Equal(t, uint32(65000), p.Conf.PeerAsn)
+			continue
+		}
+
+		assert.Equal(t, uint32(65001), p.Conf.PeerAsn)
+		assert.Equal(t, uint32(3), p.EbgpMultihop.MultihopTtl)
+		assert.Equal(t, uint64(30), p.Timers.Config.HoldTime)
+		assert.Len(t, p.AfiSafis, 1)
+	}
+
+	err = b.close()
+	assert.Nil(t, err)
+
+	_, err = newBgp(&bgpCfg{
+		AS:       65000,
+		RouterID: "127.0.0.1",
+		Peer: []*bgpPeerCfg{
+			{Address: "127.0.0.3", Families: []string{"ipx"}},
+		},
+	})
+	assert.NotNil(t, err)
+}
+
+// Test_BGPListPeers checks that the paths of a list are advertised only to the list's peers
+func Test_BGPListPeers(t *testing.T) {
+	ctx := context.Background()
+	port := rand.Intn(60000) + 2000
+
+	// The receivers accept the sessions from the source address of the tested server
+	recv := map[string]*gobgp.BgpServer{}
+	for _, addr := range []string{"127.0.0.1", "127.0.0.2"} {
+		r := gobgp.NewBgpServer()
+		go r.Serve()
+		defer r.Stop()
+
+		require.Nil(t, r.StartBgp(ctx, &api.StartBgpRequest{
+			Global: &api.Global{
+				Asn:             65000,
+				RouterId:        addr,
+				ListenPort:      int32(port),
+				ListenAddresses: []string{addr},
+			},
+		}))
+
+		require.Nil(t, r.AddPeer(ctx, &api.AddPeerRequest{
+			Peer: &api.Peer{
+				Conf:      &api.PeerConf{NeighborAddress: "127.0.0.3", PeerAsn: 65000},
+				Transport: &api.Transport{PassiveMode: true},
+			},
+		}))
+
+		recv[addr] = r
+	}
+
+	b, err := newBgp(&bgpCfg{
+		AS:       65000,
+		RouterID: "127.0.0.3",
+		NextHop:  "10.0.0.1",
+		SourceIP: "127.0.0.3",
+		Peer: []*bgpPeerCfg{
+			{Address: "127.0.0.1", Port: port, ConnectRetry: "1s"},
+			{Address: "127.0.0.2", Port: port, ConnectRetry: "1s"},
+		},
+		Policies: map[string]*bgpPolicy{
+			"video": {Peers: []string{"127.0.0.2"}},
+			"music": {},
+		},
+	})
+	require.Nil(t, err)
+	defer b.close()
+
+	// The neighbor set of the list and the export policy rejecting its paths for the others
+	var sets []*api.DefinedSet
+	err = b.s.ListDefinedSet(ctx, &api.ListDefinedSetRequest{DefinedType: api.DefinedType_NEIGHBOR}, func(ds *api.DefinedSet) {
+		sets = append(sets, ds)
+	})
+	require.Nil(t, err)
+	require.Len(t, sets, 1)
+	assert.Equal(t, "list-video-peers", sets[0].Name)
+	assert.Equal(t, []string{"127.0.0.2/32"}, sets[0].List)
+
+	var asgs []*api.PolicyAssignment
+	err = b.s.ListPolicyAssignment(ctx, &api.ListPolicyAssignmentRequest{Name: "global", Direction: api.PolicyDirection_EXPORT}, func(a *api.PolicyAssignment) {
+		asgs = append(asgs, a)
+	})
+	require.Nil(t, err)
+	require.Len(t, asgs, 1)
+	require.Len(t, asgs[0].Policies, 1)
+	assert.Equal(t, "lists", asgs[0].Policies[0].Name)
+	assert.Equal(t, api.RouteAction_ACCEPT, asgs[0].DefaultAction)
+
+	require.Nil(t, b.addHost(net.ParseIP("1.1.1.1"), ""))
+	require.Nil(t, b.addHost(net.ParseIP("2.2.2.2"), "video"))
+	require.Nil(t, b.addHost(net.ParseIP("3.3.3.3"), "music"))
+	require.Nil(t, b.start())
+
+	received := func(r *gobgp.BgpServer) (pfxs []string) {
+		r.ListPath(ctx, &api.ListPathRequest{
+			TableType: api.TableType_GLOBAL,
+			Family:    &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST},
+		}, func(d *api.Destination) {
+			pfxs = append(pfxs, d.Prefix)
+		})
+
+		sort.Strings(pfxs)
+		return
+	}
+
+	// The list's peer is checked first, so that the other one has got all the paths by then too
+	for _, w := range []struct {
+		addr string
+		pfxs []string
+	}{
+		{"127.0.0.2", []string{"1.1.1.1/32", "2.2.2.2/32", "3.3.3.3/32"}},
+		{"127.0.0.1", []string{"1.1.1.1/32", "3.3.3.3/32"}},
+	} {
+		var got []string
+		for i := 0; i < 150; i++ {
+			if got = received(recv[w.addr]); len(got) >= len(w.pfxs) {
+				break
+			}
+
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		assert.Equal(t, w.pfxs, got, w.addr)
+	}
+
+	// The withdrawn path of the list is gone
+	require.Nil(t, b.delHost(net.ParseIP("2.2.2.2"), "video"))
+	for i := 0; i < 50 && len(received(recv["127.0.0.2"])) > 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"1.1.1.1/32", "3.3.3.3/32"}, received(recv["127.0.0.2"]))
+}
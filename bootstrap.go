@@ -0,0 +1,157 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type bootstrapCfg struct {
+	// Pull the whole cache from the syncer peers
+	Peers bool
+
+	// URL or path of a snapshot: a JSON array or a newline-delimited stream of entries, optionally gzipped
+	Snapshot string
+
+	// How long to wait before starting BGP anyway, the bootstrap continues in the background then
+	Timeout string
+}
+
+// fetchSnapshot loads the entries from the snapshot URL or file. If the syncer is configured the URL
+// is fetched with its TLS settings and signed with its secret, so that a peer's /fetch can be used.
+func fetchSnapshot(src string, s *syncer, fn func(*cacheEntry)) (err error) {
+	var r io.ReadCloser
+	gz := strings.HasSuffix(src, ".gz")
+
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		u, err := url.Parse(src)
+		if err != nil {
+			return err
+		}
+
+		c := &http.Client{
+			Transport: &http.Transport{
+				ResponseHeaderTimeout: 30 * time.Second,
+			},
+		}
+
+		req := &http.Request{Method: "GET", URL: u, Header: http.Header{}}
+		if s != nil {
+			c, req = s.sc, s.newURLRequest(u, "GET", nil)
+		}
+
+		resp, err := c.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return fmt.Errorf("HTTP Code not 200: %d", resp.StatusCode)
+		}
+
+		r = resp.Body
+	} else if r, err = os.Open(src); err != nil {
+		return
+	}
+
+	defer r.Close()
+
+	var body io.Reader = r
+	if gz {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+
+		defer zr.Close()
+		body = zr
+	}
+
+	return decodeEntries(body, fn)
+}
+
+// bootstrap fills the cache from the snapshot and the peers before BGP starts
+func bootstrap(cf *bootstrapCfg, s *syncer, lists domainLists, add addFunc) (err error) {
+	if !cf.Peers && cf.Snapshot == "" {
+		return fmt.Errorf("you need to specify a snapshot or peers to bootstrap from")
+	}
+
+	if cf.Peers && s == nil {
+		return fmt.Errorf("you need to configure syncer to bootstrap from peers")
+	}
+
+	timeout := 30 * time.Second
+	if cf.Timeout != "" {
+		if timeout, err = time.ParseDuration(cf.Timeout); err != nil {
+			return fmt.Errorf("unable to parse timeout: %w", err)
+		}
+	}
+
+	// The snapshot entries are checked like the peers' ones and matched against the lists like the DB ones
+	inbound := &inboundPolicy{}
+	if s != nil {
+		inbound = s.inbound
+	}
+
+	admit := func(e *cacheEntry) bool {
+		if reason := inbound.check(e); reason != "" {
+			mSyncerRejected.WithLabelValues("snapshot", reason).Inc()
+			return false
+		}
+
+		list, ok := lists.match(e.Domain, e.Tag)
+		if !ok {
+			mSyncerRejected.WithLabelValues("snapshot", "domain").Inc()
+			return false
+		}
+
+		e.List = list
+		return true
+	}
+
+	t := time.Now()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		if cf.Snapshot != "" {
+			total, new, rejected := 0, 0, 0
+			err := fetchSnapshot(cf.Snapshot, s, func(e *cacheEntry) {
+				total++
+				e.Source = "snapshot"
+
+				if !admit(e) {
+					rejected++
+					return
+				}
+
+				if add(e, false) {
+					new++
+				}
+			})
+
+			log.Printf("Bootstrap: got %d (%d new, %d rejected) entries from snapshot, error: %v", total, new, rejected, err)
+		}
+
+		if cf.Peers {
+			s.syncAll()
+		}
+	}()
+
+	select {
+	case <-done:
+		log.Printf("Bootstrap: finished in %s", time.Since(t).Round(time.Millisecond))
+	case <-time.After(timeout):
+		log.Printf("Bootstrap: not finished in %s, continuing in the background", timeout)
+	}
+
+	return
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"compress/gzip"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_fetchSnapshot(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/snap.gz" {
+			gz := gzip.NewWriter(wr)
+			gz.Write([]byte("{\"Domain\":\"foo.bar\"}\n{\"Domain\":\"bar.foo\"}\n"))
+			gz.Close()
+			return
+		}
+
+		wr.WriteHeader(404)
+	}))
+	defer srv.Close()
+
+	f := filepath.Join(t.TempDir(), "snap.json")
+	assert.Nil(t, os.WriteFile(f, []byte(`[{"Domain":"foo.bar"}]`), 0666))
+
+	for src, n := range map[string]int{
+		srv.URL + "/snap.gz": 2,
+		f:                    1,
+	} {
+		got := 0
+		assert.Nil(t, fetchSnapshot(src, nil, func(e *cacheEntry) { got++ }), src)
+		assert.Equal(t, n, got, src)
+	}
+
+	assert.NotNil(t, fetchSnapshot(srv.URL+"/foo", nil, func(e *cacheEntry) {}))
+	assert.NotNil(t, fetchSnapshot(f+".foo", nil, func(e *cacheEntry) {}))
+
+	// The peer's /fetch is requested signed with the syncer's secret
+	s, err := newSyncer(&syncerCfg{
+		SyncInterval: "0s",
+		Secret:       "foo",
+	}, eachOf([]*cacheEntry{{IP: net.ParseIP("1.2.3.4"), Domain: "foo.bar"}}), nil, nil, nil, nil)
+	assert.Nil(t, err)
+	defer s.close()
+
+	peer := httptest.NewServer(s.auth(s.handleFetch))
+	defer peer.Close()
+
+	src := peer.URL + "/fetch?format=ndjson"
+	assert.NotNil(t, fetchSnapshot(src, nil, func(e *cacheEntry) {}))
+
+	got := 0
+	assert.Nil(t, fetchSnapshot(src, s, func(e *cacheEntry) { got++ }))
+	assert.Equal(t, 1, got)
+}
+
+func Test_bootstrap(t *testing.T) {
+	var mtx sync.Mutex
+	added := []*cacheEntry{}
+	add := func(e *cacheEntry, b bool) bool {
+		mtx.Lock()
+		added = append(added, e)
+		mtx.Unlock()
+		return true
+	}
+
+	dir := t.TempDir()
+	df := filepath.Join(dir, "domains")
+	assert.Nil(t, os.WriteFile(df, []byte("foo.bar\nbar.foo\n"), 0666))
+	lists := domainLists{}.add("video", df)
+	_, _, err := lists.loadFiles()
+	assert.Nil(t, err)
+
+	assert.NotNil(t, bootstrap(&bootstrapCfg{}, nil, lists, add))
+	assert.NotNil(t, bootstrap(&bootstrapCfg{Peers: true}, nil, lists, add))
+
+	// The entries without an IP or not matching the lists are dropped,
+	// the list is taken from the local match
+	f := filepath.Join(dir, "snap.json")
+	assert.Nil(t, os.WriteFile(f, []byte(`{"IP":"1.2.3.4","Domain":"foo.bar","List":"evil"}
+{"Domain":"foo.bar"}
+{"IP":"1.2.3.4","Domain":"evil.com"}`), 0666))
+
+	assert.Nil(t, bootstrap(&bootstrapCfg{Snapshot: f}, nil, lists, add))
+	assert.Len(t, added, 1)
+	assert.Equal(t, "snapshot", added[0].Source)
+	assert.Equal(t, "video", added[0].List)
+
+	// The inbound policy of the syncer applies
+	s, err := newSyncer(&syncerCfg{
+		SyncInterval: "0s",
+		Inbound:      &inboundCfg{Deny: []string{"1.2.3.0/24"}},
+	}, nil, add, nil, nil, lists)
+	assert.Nil(t, err)
+	defer s.close()
+
+	assert.Nil(t, bootstrap(&bootstrapCfg{Snapshot: f}, s, lists, add))
+	assert.Len(t, added, 1)
+
+	// The snapshot which doesn't arrive in time is loaded in the background
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		<-block
+		wr.Write([]byte(`{"IP":"1.2.3.4","Domain":"bar.foo"}`))
+	}))
+	defer srv.Close()
+
+	t0 := time.Now()
+	assert.Nil(t, bootstrap(&bootstrapCfg{Snapshot: srv.URL, Timeout: "100ms"}, nil, lists, add))
+	assert.Less(t, time.Since(t0), time.Second)
+	close(block)
+
+	for i := 0; i < 50; i++ {
+		mtx.Lock()
+		n := len(added)
+		mtx.Unlock()
+
+		if n == 2 {
+			break
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	mtx.Lock()
+	assert.Len(t, added, 2)
+	mtx.Unlock()
+}
@@ -7,76 +7,449 @@ import (
 )
 
 type cacheEntry struct {
-	IP     net.IP
+	IP net.IP
+	// The name which matched the list
 	Domain string
-	TS     time.Time
+	List   string
+	// The whole CNAME chain of the reply, for troubleshooting
+	Chain []string
+	// Where the entry came from: "dnstap", "proxy", "pdns", "peer <addr>" or "manual"
+	Source string
+	// Tag of the DNSTap listener the reply came from
+	Tag     string `json:",omitempty"`
+	TS      time.Time
+	Expires time.Time
+	// A tombstone: the reference was removed at TS, it's only passed between the peers
+	Deleted bool `json:",omitempty"`
+	// ID of the instance the entry was pushed from first and of all instances it passed through
+	Origin string   `json:",omitempty"`
+	Hops   []string `json:",omitempty"`
 }
 
-type expireFunc func(*cacheEntry)
+// expireFunc is called for every removed domain reference of an IP.
+// next is the reference the IP is announced with from now on
+// or nil if it was the last one and the IP should be withdrawn.
+type expireFunc func(e, next *cacheEntry)
+
+// addedFunc is called for every added domain reference, announce is true
+// if it's the first reference of the IP and the IP should be announced.
+type addedFunc func(e *cacheEntry, announce bool)
+
+// cacheIP holds the domains referencing the IP
+type cacheIP struct {
+	// The reference which defines the announcement policy
+	ann  *cacheEntry
+	refs map[string]*cacheEntry
+}
+
+// update replaces the reference with its copy changed by fn. The cached entries are never
+// changed in place, so that the ones handed out of the cache can be read without the lock.
+func (cip *cacheIP) update(e *cacheEntry, fn func(*cacheEntry)) *cacheEntry {
+	ne := *e
+	fn(&ne)
+
+	cip.refs[e.Domain] = &ne
+	if cip.ann == e {
+		cip.ann = &ne
+	}
+
+	return &ne
+}
+
+func ipKey(ip net.IP) string {
+	return string(ip.To16())
+}
+
+// ttlPolicy calculates the lifetime of an entry:
+// either a fixed one or based on the TTL of the DNS record
+type ttlPolicy struct {
+	fixed time.Duration
+
+	dns        bool
+	multiplier float64
+	min        time.Duration
+	max        time.Duration
+}
+
+func (p *ttlPolicy) lifetime(ttl uint32) (d time.Duration) {
+	if !p.dns {
+		return p.fixed
+	}
+
+	d = time.Duration(float64(ttl) * p.multiplier * float64(time.Second))
+	if d < p.min {
+		d = p.min
+	}
+
+	if p.max > 0 && d > p.max {
+		d = p.max
+	}
+
+	return
+}
+
+// mergeResult is the outcome of applying an entry received from a peer
+type mergeResult int
+
+const (
+	// The entry is older than the cached reference or its tombstone
+	mergeStale mergeResult = iota
+	// The reference isn't cached and should be added
+	mergeNew
+	mergeRefreshed
+	mergeDeleted
+)
 
 type cache struct {
-	m        map[string]*cacheEntry
+	m        map[string]*cacheIP
 	ttl      time.Duration
+	addCb    addedFunc
 	expireCb expireFunc
 	sync.RWMutex
+
+	// The tombstones of the removed references by IP and domain, kept until the reference would expire
+	tombs   map[string]*cacheEntry
+	tombMtx sync.Mutex
+}
+
+// How often the expired entries are purged
+const cleanupInterval = time.Minute
+
+func tombKey(e *cacheEntry) string {
+	return ipKey(e.IP) + e.Domain
 }
 
 func (c *cache) cleanupScheduler() {
 	for {
 		c.cleanup()
-		time.Sleep(time.Minute)
+		time.Sleep(cleanupInterval)
 	}
 }
 
 func (c *cache) cleanup() {
 	now := time.Now()
-	c.Lock()
-	for k, v := range c.m {
-		if now.Sub(v.TS) >= c.ttl {
-			delete(c.m, k)
+	c.purge(func(e *cacheEntry) bool {
+		return !now.Before(e.Expires)
+	}, c.expireCb)
+
+	c.tombMtx.Lock()
+	for k, t := range c.tombs {
+		if !now.Before(t.Expires) {
+			delete(c.tombs, k)
+		}
+	}
+	c.tombMtx.Unlock()
+}
+
+// tombstone remembers the removal of the reference so that its older versions
+// coming from the peers are ignored. It doesn't use the cache lock so it's safe to call from expireFunc.
+func (c *cache) tombstone(t *cacheEntry) {
+	cp := *t
+	if cp.Expires.IsZero() {
+		cp.Expires = cp.TS.Add(c.ttl)
+	}
+
+	c.tombMtx.Lock()
+	defer c.tombMtx.Unlock()
 
-			if c.expireCb != nil {
-				c.expireCb(v)
+	k := tombKey(&cp)
+	if ct, ok := c.tombs[k]; ok && ct.TS.After(cp.TS) {
+		return
+	}
+
+	c.tombs[k] = &cp
+}
+
+// tombstoned returns true if the reference was removed not earlier than the entry's timestamp
+func (c *cache) tombstoned(e *cacheEntry) bool {
+	c.tombMtx.Lock()
+	defer c.tombMtx.Unlock()
+
+	t, ok := c.tombs[tombKey(e)]
+	return ok && !e.TS.After(t.TS)
+}
+
+// remove deletes the reference, the lock should be held
+func (c *cache) remove(e *cacheEntry) (next *cacheEntry) {
+	k := ipKey(e.IP)
+	ip := c.m[k]
+	delete(ip.refs, e.Domain)
+
+	if len(ip.refs) == 0 {
+		delete(c.m, k)
+		return nil
+	}
+
+	if ip.ann == e {
+		ip.ann = nil
+		for _, r := range ip.refs {
+			if ip.ann == nil || r.TS.Before(ip.ann.TS) {
+				ip.ann = r
 			}
 		}
 	}
-	c.Unlock()
+
+	return ip.ann
 }
 
-func (c *cache) exists(ip net.IP, update bool) bool {
+// refresh extends the deadline of a cached reference if the new one is later and bumps its timestamp
+// if it's at least minAge newer. Returns a copy of the updated entry or nil if it's not cached
+// and whether the timestamp was bumped.
+func (c *cache) refresh(e *cacheEntry, minAge time.Duration) (*cacheEntry, bool) {
 	c.Lock()
-	e, ok := c.m[string(ip)]
-	if ok && update {
-		e.TS = time.Now()
+	defer c.Unlock()
+
+	cip, ok := c.m[ipKey(e.IP)]
+	if !ok {
+		return nil, false
+	}
+
+	ce, ok := cip.refs[e.Domain]
+	if !ok {
+		return nil, false
 	}
-	c.Unlock()
-	return ok
+
+	bumped := e.TS.Sub(ce.TS) >= minAge
+	ce = cip.update(ce, func(ne *cacheEntry) {
+		if e.Expires.After(ne.Expires) {
+			ne.Expires = e.Expires
+		}
+
+		if bumped {
+			ne.TS = e.TS
+		}
+	})
+
+	cp := *ce
+	return &cp, bumped
 }
 
-func (c *cache) add(e *cacheEntry) {
+// merge applies an entry received from a peer, the last writer wins by the timestamp:
+// a newer version refreshes the cached reference and a newer tombstone removes it.
+// For the refreshed reference ce is its copy, the removed one is passed to cb under the lock.
+func (c *cache) merge(e *cacheEntry, cb expireFunc) (res mergeResult, ce *cacheEntry) {
+	if e.Deleted {
+		c.tombstone(e)
+	} else if c.tombstoned(e) {
+		return mergeStale, nil
+	}
+
 	c.Lock()
-	c.m[string(e.IP)] = e
-	c.Unlock()
+	defer c.Unlock()
+
+	cip, ok := c.m[ipKey(e.IP)]
+	if ok {
+		ce = cip.refs[e.Domain]
+	}
+
+	switch {
+	case ce == nil && e.Deleted:
+		return mergeStale, nil
+	case ce == nil:
+		return mergeNew, nil
+	case !e.TS.After(ce.TS):
+		return mergeStale, nil
+	case e.Deleted:
+		next := c.remove(ce)
+		if cb != nil {
+			cb(ce, next)
+		}
+
+		return mergeDeleted, nil
+	}
+
+	ce = cip.update(ce, func(ne *cacheEntry) {
+		ne.TS = e.TS
+		if e.Expires.After(ne.Expires) {
+			ne.Expires = e.Expires
+		}
+	})
+
+	cp := *ce
+	return mergeRefreshed, &cp
 }
 
+// add stores a copy of the reference, the entries without a deadline get the default one.
+// Returns true if the IP wasn't referenced before. addCb is called under the lock.
+func (c *cache) add(e *cacheEntry) bool {
+	if e.Expires.IsZero() {
+		e.Expires = e.TS.Add(c.ttl)
+	}
+
+	cp := *e
+	e = &cp
+
+	c.Lock()
+	defer c.Unlock()
+
+	k := ipKey(e.IP)
+	cip, ok := c.m[k]
+	if !ok {
+		c.m[k] = &cacheIP{
+			ann:  e,
+			refs: map[string]*cacheEntry{e.Domain: e},
+		}
+
+		if c.addCb != nil {
+			c.addCb(e, true)
+		}
+
+		return true
+	}
+
+	if cip.ann.Domain == e.Domain {
+		cip.ann = e
+	}
+
+	cip.refs[e.Domain] = e
+	if c.addCb != nil {
+		c.addCb(e, false)
+	}
+
+	return false
+}
+
+// purge removes the references for which fn returns true and calls cb for each of them
+func (c *cache) purge(fn func(*cacheEntry) bool, cb expireFunc) (n int) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, cip := range c.m {
+		for _, e := range cip.refs {
+			if !fn(e) {
+				continue
+			}
+
+			next := c.remove(e)
+			if cb != nil {
+				cb(e, next)
+			}
+
+			n++
+		}
+	}
+
+	return
+}
+
+// relist moves the references to the lists returned by fn, the ones for which it returns false are kept as is.
+// cb is called for each moved reference with its new version and whether the IP is announced with it.
+func (c *cache) relist(fn func(*cacheEntry) (string, bool), cb func(e, ne *cacheEntry, ann bool)) (n int) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, cip := range c.m {
+		for _, e := range cip.refs {
+			list, ok := fn(e)
+			if !ok || list == e.List {
+				continue
+			}
+
+			ann := cip.ann == e
+			ne := cip.update(e, func(ne *cacheEntry) {
+				ne.List = list
+			})
+
+			cb(e, ne, ann)
+			n++
+		}
+	}
+
+	return
+}
+
+// get returns copies of the references of the IP
+func (c *cache) get(ip net.IP) (es []*cacheEntry) {
+	c.RLock()
+	defer c.RUnlock()
+
+	cip, ok := c.m[ipKey(ip)]
+	if !ok {
+		return
+	}
+
+	for _, e := range cip.refs {
+		cp := *e
+		es = append(es, &cp)
+	}
+
+	return
+}
+
+// getAll returns copies of all references of all IPs
 func (c *cache) getAll() (es []*cacheEntry) {
 	c.RLock()
-	for _, e := range c.m {
-		es = append(es, e)
+	defer c.RUnlock()
+
+	for _, cip := range c.m {
+		for _, e := range cip.refs {
+			cp := *e
+			es = append(es, &cp)
+		}
+	}
+
+	return
+}
+
+// each calls fn with the copies of all references until it returns false. The lock is taken
+// for each IP separately, so that a slow consumer doesn't block the cache.
+func (c *cache) each(fn func(*cacheEntry) bool) {
+	c.RLock()
+	keys := make([]string, 0, len(c.m))
+	for k := range c.m {
+		keys = append(keys, k)
 	}
 	c.RUnlock()
+
+	var es []*cacheEntry
+	for _, k := range keys {
+		es = es[:0]
+
+		c.RLock()
+		if cip, ok := c.m[k]; ok {
+			for _, e := range cip.refs {
+				cp := *e
+				es = append(es, &cp)
+			}
+		}
+		c.RUnlock()
+
+		for _, e := range es {
+			if !fn(e) {
+				return
+			}
+		}
+	}
+}
+
+// countFamily returns the number of IPv4 and IPv6 addresses
+func (c *cache) countFamily() (v4, v6 int) {
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, cip := range c.m {
+		if cip.ann.IP.To4() != nil {
+			v4++
+		} else {
+			v6++
+		}
+	}
+
 	return
 }
 
+// count returns the number of IPs
 func (c *cache) count() int {
-	c.Lock()
-	defer c.Unlock()
+	c.RLock()
+	defer c.RUnlock()
 	return len(c.m)
 }
 
-func newCache(ttl time.Duration, expireCb expireFunc) (c *cache) {
+func newCache(ttl time.Duration, addCb addedFunc, expireCb expireFunc) (c *cache) {
 	c = &cache{
-		m:        map[string]*cacheEntry{},
+		m:        map[string]*cacheIP{},
+		tombs:    map[string]*cacheEntry{},
+		addCb:    addCb,
 		expireCb: expireCb,
 		ttl:      ttl,
 	}
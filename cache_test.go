@@ -8,21 +8,42 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// cached returns true if the IP is referenced by the domain
+func cached(c *cache, ip net.IP, domain string) bool {
+	for _, e := range c.get(ip) {
+		if e.Domain == domain {
+			return true
+		}
+	}
+
+	return false
+}
+
 func Test_Cache(t *testing.T) {
-	expired := 0
-	cb := func(e *cacheEntry) {
+	expired, announced := 0, 0
+	cb := func(e, next *cacheEntry) {
 		expired++
 	}
 
+	added := 0
+	acb := func(e *cacheEntry, announce bool) {
+		added++
+		if announce {
+			announced++
+		}
+	}
+
 	e := &cacheEntry{
 		IP:     net.ParseIP("1.2.3.4"),
 		Domain: "test.foo",
 		TS:     time.Now(),
 	}
 
-	c := newCache(time.Millisecond, cb)
+	c := newCache(time.Millisecond, acb, cb)
 	c.add(e)
-	assert.True(t, c.exists(e.IP, false))
+	assert.Equal(t, 1, announced)
+	assert.True(t, cached(c, e.IP, e.Domain))
+	assert.False(t, cached(c, e.IP, "foo.test"))
 	assert.Equal(t, 1, c.count())
 	ee := c.getAll()
 	assert.Equal(t, e, ee[0])
@@ -30,4 +51,300 @@ func Test_Cache(t *testing.T) {
 	c.cleanup()
 	assert.Equal(t, 0, c.count())
 	assert.Equal(t, 1, expired)
+
+	// Only the first reference of an IP is announced
+	c.add(&cacheEntry{IP: e.IP, Domain: "foo.test", TS: time.Now()})
+	c.add(&cacheEntry{IP: e.IP, Domain: "bar.test", TS: time.Now()})
+	assert.Equal(t, 2, announced)
+	assert.Equal(t, 3, added)
+}
+
+func Test_CacheRefresh(t *testing.T) {
+	now := time.Now()
+	e := &cacheEntry{
+		IP:      net.ParseIP("1.2.3.4"),
+		Domain:  "test.foo",
+		TS:      now,
+		Expires: now.Add(time.Minute),
+	}
+
+	c := newCache(time.Hour, nil, nil)
+	ce, _ := c.refresh(e, 0)
+	assert.Nil(t, ce)
+	c.add(e)
+
+	ce, _ = c.refresh(&cacheEntry{IP: e.IP, Domain: "foo.test"}, 0)
+	assert.Nil(t, ce)
+
+	ce, bumped := c.refresh(&cacheEntry{
+		IP:      e.IP,
+		Domain:  e.Domain,
+		TS:      now.Add(time.Second),
+		Expires: now.Add(time.Second),
+	}, 0)
+	assert.True(t, bumped)
+	assert.Equal(t, now.Add(time.Second), ce.TS)
+	assert.Equal(t, now.Add(time.Minute), ce.Expires)
+
+	// The deadline is extended but the timestamp is too recent to bump
+	ce, bumped = c.refresh(&cacheEntry{
+		IP:      e.IP,
+		Domain:  e.Domain,
+		TS:      now.Add(2 * time.Second),
+		Expires: now.Add(time.Hour),
+	}, time.Minute)
+	assert.False(t, bumped)
+	assert.Equal(t, now.Add(time.Second), ce.TS)
+	assert.Equal(t, now.Add(time.Hour), ce.Expires)
+
+	e2 := &cacheEntry{
+		IP: net.ParseIP("4.3.2.1"),
+		TS: now,
+	}
+	c.add(e2)
+	assert.Equal(t, now.Add(time.Hour), e2.Expires)
+}
+
+func Test_ttlPolicy(t *testing.T) {
+	p := &ttlPolicy{fixed: time.Hour}
+	assert.Equal(t, time.Hour, p.lifetime(60))
+
+	p = &ttlPolicy{
+		dns:        true,
+		multiplier: 2,
+		min:        time.Minute,
+		max:        time.Hour,
+	}
+
+	assert.Equal(t, 10*time.Minute, p.lifetime(300))
+	assert.Equal(t, time.Minute, p.lifetime(5))
+	assert.Equal(t, time.Hour, p.lifetime(86400))
+
+	// The lower bound defaults to the cleanup interval
+	p, err := (&cfgRoot{TTLMode: "dns"}).ttlPolicy(time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, cleanupInterval, p.lifetime(0))
+
+	p, err = (&cfgRoot{TTLMode: "dns", TTLMax: "30s"}).ttlPolicy(time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, p.lifetime(0))
+
+	_, err = (&cfgRoot{TTLMode: "dns", TTLMin: "2h"}).ttlPolicy(time.Hour)
+	assert.NotNil(t, err)
+}
+
+func Test_CachePurge(t *testing.T) {
+	c := newCache(time.Hour, nil, nil)
+
+	for ip, d := range map[string]string{"1.2.3.4": "foo.bar", "4.3.2.1": "bar.foo"} {
+		c.add(&cacheEntry{
+			IP:     net.ParseIP(ip),
+			Domain: d,
+			TS:     time.Now(),
+		})
+	}
+
+	es := []*cacheEntry{}
+	n := c.purge(func(e *cacheEntry) bool {
+		return e.Domain == "foo.bar"
+	}, func(e, next *cacheEntry) {
+		assert.Nil(t, next)
+		es = append(es, e)
+	})
+
+	assert.Equal(t, 1, n)
+	assert.Len(t, es, 1)
+	assert.Equal(t, "foo.bar", es[0].Domain)
+	assert.Equal(t, 1, c.count())
+}
+
+func Test_CacheEach(t *testing.T) {
+	c := newCache(time.Hour, nil, nil)
+	for _, d := range []string{"a.foo", "b.foo", "c.foo"} {
+		c.add(&cacheEntry{IP: net.ParseIP("1.2.3.4"), Domain: d, TS: time.Now()})
+	}
+
+	c.add(&cacheEntry{IP: net.ParseIP("4.3.2.1"), Domain: "d.foo", TS: time.Now()})
+
+	n := 0
+	c.each(func(e *cacheEntry) bool {
+		// The copies can be changed freely
+		e.Domain = "x"
+		n++
+		return true
+	})
+
+	assert.Equal(t, 4, n)
+	assert.True(t, cached(c, net.ParseIP("1.2.3.4"), "a.foo"))
+
+	n = 0
+	c.each(func(e *cacheEntry) bool {
+		n++
+		return n < 2
+	})
+
+	assert.Equal(t, 2, n)
+}
+
+func Test_CacheCopies(t *testing.T) {
+	c := newCache(time.Hour, nil, nil)
+	e := &cacheEntry{IP: net.ParseIP("1.2.3.4"), Domain: "foo.bar", TS: time.Now()}
+	c.add(e)
+
+	// The entries handed out are not changed by the later refreshes and merges
+	es := c.getAll()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 100; i++ {
+			c.refresh(&cacheEntry{IP: e.IP, Domain: e.Domain, TS: e.TS.Add(time.Duration(i) * time.Second)}, 0)
+			c.merge(&cacheEntry{IP: e.IP, Domain: e.Domain, TS: e.TS.Add(time.Duration(i)*time.Second + 1)}, nil)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		c.each(func(ce *cacheEntry) bool {
+			_ = ce.TS.String()
+			return true
+		})
+	}
+
+	<-done
+	assert.True(t, es[0].TS.Equal(e.TS))
+	assert.True(t, c.get(e.IP)[0].TS.Equal(e.TS.Add(100*time.Second+1)))
+}
+
+func Test_CacheRelist(t *testing.T) {
+	now := time.Now()
+	ip := net.ParseIP("1.2.3.4")
+
+	c := newCache(time.Hour, nil, nil)
+	c.add(&cacheEntry{IP: ip, Domain: "foo.bar", List: "a", TS: now})
+	c.add(&cacheEntry{IP: ip, Domain: "bar.foo", List: "a", TS: now.Add(time.Second)})
+
+	type move struct {
+		from, to string
+		ann      bool
+	}
+
+	moves := []move{}
+	n := c.relist(func(e *cacheEntry) (string, bool) {
+		if e.Domain == "foo.bar" {
+			return "b", true
+		}
+
+		return "", false
+	}, func(e, ne *cacheEntry, ann bool) {
+		moves = append(moves, move{e.List, ne.List, ann})
+	})
+
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []move{{"a", "b", true}}, moves)
+
+	for _, e := range c.get(ip) {
+		if e.Domain == "foo.bar" {
+			assert.Equal(t, "b", e.List)
+		} else {
+			assert.Equal(t, "a", e.List)
+		}
+	}
+}
+
+func Test_CacheRefs(t *testing.T) {
+	now := time.Now()
+	ip := net.ParseIP("1.2.3.4")
+
+	e1 := &cacheEntry{IP: ip.To4(), Domain: "foo.bar", List: "a", TS: now}
+	e2 := &cacheEntry{IP: ip, Domain: "bar.foo", List: "b", TS: now.Add(time.Second)}
+	e3 := &cacheEntry{IP: ip, Domain: "baz.foo", List: "b", TS: now.Add(2 * time.Second)}
+
+	c := newCache(time.Hour, nil, nil)
+	assert.True(t, c.add(e1))
+	assert.False(t, c.add(e2))
+	assert.False(t, c.add(e3))
+	assert.Equal(t, 1, c.count())
+	assert.Len(t, c.getAll(), 3)
+
+	type drop struct {
+		e, next *cacheEntry
+	}
+
+	drops := []drop{}
+	cb := func(e, next *cacheEntry) {
+		drops = append(drops, drop{e, next})
+	}
+
+	// The announcing reference goes away - the oldest remaining one takes over
+	c.purge(func(e *cacheEntry) bool { return e.Domain == "foo.bar" }, cb)
+	assert.Equal(t, []drop{{e1, e2}}, drops)
+
+	drops = drops[:0]
+	c.purge(func(e *cacheEntry) bool { return e.Domain == "baz.foo" }, cb)
+	assert.Equal(t, []drop{{e3, e2}}, drops)
+	assert.Equal(t, 1, c.count())
+
+	drops = drops[:0]
+	c.purge(func(e *cacheEntry) bool { return true }, cb)
+	assert.Equal(t, []drop{{e2, nil}}, drops)
+	assert.Equal(t, 0, c.count())
+}
+
+func Test_CacheMerge(t *testing.T) {
+	now := time.Now()
+	ip := net.ParseIP("1.2.3.4")
+	e := func(domain string, ts time.Duration, deleted bool) *cacheEntry {
+		return &cacheEntry{IP: ip, Domain: domain, TS: now.Add(ts), Expires: now.Add(ts + time.Hour), Deleted: deleted}
+	}
+
+	c := newCache(time.Hour, nil, nil)
+
+	res, _ := c.merge(e("foo.bar", 0, false), nil)
+	assert.Equal(t, mergeNew, res)
+	c.add(e("foo.bar", 0, false))
+	c.add(e("bar.foo", 0, false))
+
+	// Same version
+	res, _ = c.merge(e("foo.bar", 0, false), nil)
+	assert.Equal(t, mergeStale, res)
+
+	res, ce := c.merge(e("foo.bar", time.Minute, false), nil)
+	assert.Equal(t, mergeRefreshed, res)
+	assert.Equal(t, now.Add(time.Minute+time.Hour), ce.Expires)
+
+	// The tombstone older than the reference is ignored
+	res, _ = c.merge(e("foo.bar", time.Second, true), nil)
+	assert.Equal(t, mergeStale, res)
+	assert.True(t, cached(c, ip, "foo.bar"))
+
+	var removed, next *cacheEntry
+	res, _ = c.merge(e("foo.bar", 2*time.Minute, true), func(e, n *cacheEntry) {
+		// Called under the lock
+		assert.False(t, c.TryLock())
+		removed, next = e, n
+	})
+	assert.Equal(t, mergeDeleted, res)
+	assert.Equal(t, "foo.bar", removed.Domain)
+	assert.Equal(t, "bar.foo", next.Domain)
+	assert.False(t, cached(c, ip, "foo.bar"))
+
+	// The versions up to the tombstone aren't resurrected
+	res, _ = c.merge(e("foo.bar", time.Minute, false), nil)
+	assert.Equal(t, mergeStale, res)
+	res, _ = c.merge(e("foo.bar", 2*time.Minute, false), nil)
+	assert.Equal(t, mergeStale, res)
+	res, _ = c.merge(e("foo.bar", 3*time.Minute, false), nil)
+	assert.Equal(t, mergeNew, res)
+
+	// Tombstones of the unknown references are remembered too
+	res, _ = c.merge(e("baz.bar", time.Minute, true), nil)
+	assert.Equal(t, mergeStale, res)
+	res, _ = c.merge(e("baz.bar", 0, false), nil)
+	assert.Equal(t, mergeStale, res)
+
+	// Expired tombstones are cleaned up
+	c.tombstone(&cacheEntry{IP: ip, Domain: "old.bar", TS: now.Add(-2 * time.Hour), Expires: now.Add(-time.Hour)})
+	assert.True(t, c.tombstoned(e("old.bar", -2*time.Hour, false)))
+	c.cleanup()
+	assert.False(t, c.tombstoned(e("old.bar", -2*time.Hour, false)))
+	assert.True(t, c.tombstoned(e("baz.bar", 0, false)))
 }
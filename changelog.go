@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// changeLog keeps the last cache additions numbered by a sequence so that the peers
+// can fetch only the changes since their last sync. The epoch identifies the log:
+// if it's not persisted the sequence starts over on restart and the peers have to resync fully.
+type changeLog struct {
+	epoch string
+	seq   uint64
+	// The log has the changes after this sequence number
+	base  uint64
+	buf   []*cacheEntry
+	store changeStore
+	// Closed and replaced on every addition to wake up the watchers
+	notify chan struct{}
+	sync.RWMutex
+
+	// The changes not yet persisted, ending with the pendingSeq one. They're written
+	// in the background so that neither the additions nor the peers wait for the DB.
+	pending    []*cacheEntry
+	pendingSeq uint64
+	pendingMtx sync.Mutex
+	persistCh  chan struct{}
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+// changeStore persists the change log so that the peers resume their delta syncs after a restart
+type changeStore interface {
+	// loadChanges returns the saved epoch, empty if there's none, and at most max last
+	// consecutive changes along with the sequence number of the last one
+	loadChanges(max int) (epoch string, seq uint64, es []*cacheEntry, err error)
+	saveEpoch(epoch string) error
+	// saveChanges stores the consecutive changes ending with the last one
+	// and drops the ones which fell out of the log of the given size
+	saveChanges(last uint64, es []*cacheEntry, size int) error
+}
+
+// syncState is the progress of syncing with a peer
+type syncState struct {
+	Epoch string
+	Seq   uint64
+}
+
+func newChangeLog(size int, store changeStore) (l *changeLog, err error) {
+	l = &changeLog{
+		buf:    make([]*cacheEntry, size),
+		store:  store,
+		notify: make(chan struct{}),
+	}
+
+	if store == nil {
+		l.epoch = newEpoch()
+		return
+	}
+
+	defer func() {
+		if err == nil {
+			l.persistCh = make(chan struct{}, 1)
+			l.done = make(chan struct{})
+			l.stopped = make(chan struct{})
+			go l.persist()
+		}
+	}()
+
+	epoch, seq, es, err := store.loadChanges(size)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load change log: %w", err)
+	}
+
+	if epoch == "" {
+		l.epoch = newEpoch()
+		if err = store.saveEpoch(l.epoch); err != nil {
+			return nil, fmt.Errorf("unable to save change log epoch: %w", err)
+		}
+
+		return
+	}
+
+	l.epoch, l.seq, l.pendingSeq = epoch, seq, seq
+	l.base = seq - uint64(len(es))
+	for i, e := range es {
+		l.buf[(l.base+uint64(i)+1)%uint64(size)] = e
+	}
+
+	return
+}
+
+func newEpoch() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (l *changeLog) add(e *cacheEntry) uint64 {
+	cp := *e
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.seq++
+	size := uint64(len(l.buf))
+	l.buf[l.seq%size] = &cp
+	if l.seq-l.base > size {
+		l.base = l.seq - size
+	}
+
+	if l.store != nil {
+		l.pendingMtx.Lock()
+		// The older ones would be dropped from the DB right away
+		if l.pending = append(l.pending, &cp); len(l.pending) > len(l.buf) {
+			l.pending = l.pending[1:]
+		}
+		l.pendingSeq = l.seq
+		l.pendingMtx.Unlock()
+
+		wake(l.persistCh)
+	}
+
+	close(l.notify)
+	l.notify = make(chan struct{})
+	return l.seq
+}
+
+// persist writes the pending changes until the log is closed
+func (l *changeLog) persist() {
+	defer close(l.stopped)
+
+	for {
+		select {
+		case <-l.persistCh:
+			l.flush()
+		case <-l.done:
+			l.flush()
+			return
+		}
+	}
+}
+
+// flush writes the pending changes in one transaction.
+// The log loaded after a failed write ends before the gap, so the peers just resync fully.
+func (l *changeLog) flush() {
+	l.pendingMtx.Lock()
+	es, last := l.pending, l.pendingSeq
+	l.pending = nil
+	l.pendingMtx.Unlock()
+
+	if len(es) == 0 {
+		return
+	}
+
+	if err := l.store.saveChanges(last, es, len(l.buf)); err != nil {
+		log.Printf("Syncer: unable to save %d changes up to %d: %s", len(es), last, err)
+	}
+}
+
+// close writes the pending changes and stops persisting the new ones
+func (l *changeLog) close() {
+	if l.store == nil {
+		return
+	}
+
+	close(l.done)
+	<-l.stopped
+}
+
+// wait returns a channel which is closed when the next entry is added
+func (l *changeLog) wait() <-chan struct{} {
+	l.RLock()
+	defer l.RUnlock()
+	return l.notify
+}
+
+func (l *changeLog) state() *syncState {
+	l.RLock()
+	defer l.RUnlock()
+
+	return &syncState{
+		Epoch: l.epoch,
+		Seq:   l.seq,
+	}
+}
+
+// since returns at most max entries following the given sequence number and the sequence of the last one.
+// ok is false if the entries are no longer in the log and a full resync is needed.
+func (l *changeLog) since(epoch string, seq uint64, max int) (es []*cacheEntry, last uint64, ok bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	size := uint64(len(l.buf))
+	if epoch != l.epoch || seq > l.seq || seq < l.base {
+		return nil, 0, false
+	}
+
+	for last = seq; last < l.seq && len(es) < max; last++ {
+		es = append(es, l.buf[(last+1)%size])
+	}
+
+	return es, last, true
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_changeLog(t *testing.T) {
+	l, err := newChangeLog(3, nil)
+	assert.Nil(t, err)
+	st := l.state()
+	assert.Equal(t, uint64(0), st.Seq)
+
+	es, last, ok := l.since(st.Epoch, 0, 10)
+	assert.True(t, ok)
+	assert.Len(t, es, 0)
+	assert.Equal(t, uint64(0), last)
+
+	for _, d := range []string{"a.foo", "b.foo", "c.foo", "d.foo"} {
+		l.add(&cacheEntry{
+			IP:     net.ParseIP("1.2.3.4"),
+			Domain: d,
+			TS:     time.Now(),
+		})
+	}
+
+	// The first one was overwritten
+	_, _, ok = l.since(st.Epoch, 0, 10)
+	assert.False(t, ok)
+
+	es, last, ok = l.since(st.Epoch, 1, 10)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(4), last)
+	assert.Equal(t, "b.foo", es[0].Domain)
+	assert.Equal(t, "d.foo", es[2].Domain)
+
+	es, last, ok = l.since(st.Epoch, 1, 2)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), last)
+	assert.Len(t, es, 2)
+
+	_, _, ok = l.since("foo", 1, 10)
+	assert.False(t, ok)
+
+	_, _, ok = l.since(st.Epoch, 5, 10)
+	assert.False(t, ok)
+
+	ch := l.wait()
+	select {
+	case <-ch:
+		t.Fatal("notified without changes")
+	default:
+	}
+
+	l.add(&cacheEntry{IP: net.ParseIP("1.2.3.4"), Domain: "e.foo"})
+	<-ch
+}
+
+func Test_changeLogStore(t *testing.T) {
+	f := "__test_changes.db"
+	defer os.Remove(f)
+
+	db, err := newDB(f)
+	assert.Nil(t, err)
+
+	l, err := newChangeLog(3, db)
+	assert.Nil(t, err)
+	st := l.state()
+
+	for _, d := range []string{"a.foo", "b.foo", "c.foo", "d.foo"} {
+		l.add(&cacheEntry{IP: net.ParseIP("1.2.3.4"), Domain: d, TS: time.Now()})
+	}
+
+	// The pending changes are written on close
+	l.close()
+
+	// Resumes after a restart
+	l, err = newChangeLog(3, db)
+	assert.Nil(t, err)
+	assert.Equal(t, &syncState{Epoch: st.Epoch, Seq: 4}, l.state())
+
+	es, last, ok := l.since(st.Epoch, 1, 10)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(4), last)
+	assert.Len(t, es, 3)
+	assert.Equal(t, "b.foo", es[0].Domain)
+
+	_, _, ok = l.since(st.Epoch, 0, 10)
+	assert.False(t, ok)
+
+	// A smaller log keeps only the last changes
+	l.close()
+	l, err = newChangeLog(2, db)
+	assert.Nil(t, err)
+	_, _, ok = l.since(st.Epoch, 1, 10)
+	assert.False(t, ok)
+
+	es, _, ok = l.since(st.Epoch, 2, 10)
+	assert.True(t, ok)
+	assert.Equal(t, "c.foo", es[0].Domain)
+
+	l.add(&cacheEntry{IP: net.ParseIP("1.2.3.4"), Domain: "e.foo", TS: time.Now()})
+	es, last, ok = l.since(st.Epoch, 3, 10)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(5), last)
+	assert.Len(t, es, 2)
+
+	// The changes which fell out of the log are dropped from the DB
+	l.close()
+	_, seq, es, err := db.loadChanges(10)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), seq)
+	assert.Len(t, es, 2)
+
+	assert.Nil(t, db.close())
+}
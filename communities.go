@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/ptypes/any"
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+	"github.com/osrg/gobgp/v3/pkg/packet/bgp"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+type bgpCommunities struct {
+	// "AS:value", a number or a well-known name like "no-export"
+	Communities []string
+	// "global:local1:local2"
+	LargeCommunities []string
+	// "rt:AS:value" or "soo:AS:value", IPs and 4-byte ASes are also accepted
+	ExtCommunities []string
+}
+
+func parseCommunity(s string) (c uint32, err error) {
+	if v, ok := bgp.WellKnownCommunityValueMap[s]; ok {
+		return uint32(v), nil
+	}
+
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(v), nil
+	}
+
+	t := strings.SplitN(s, ":", 2)
+	if len(t) != 2 {
+		return 0, fmt.Errorf("unable to parse '%s' as community", s)
+	}
+
+	as, err := strconv.ParseUint(t[0], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse '%s' as community: %w", s, err)
+	}
+
+	v, err := strconv.ParseUint(t[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse '%s' as community: %w", s, err)
+	}
+
+	return uint32(as<<16 | v), nil
+}
+
+func parseExtCommunity(s string) (c bgp.ExtendedCommunityInterface, err error) {
+	t := strings.SplitN(s, ":", 2)
+	if len(t) != 2 {
+		return nil, fmt.Errorf("unable to parse '%s' as extended community", s)
+	}
+
+	var st bgp.ExtendedCommunityAttrSubType
+	switch strings.ToLower(t[0]) {
+	case "rt":
+		st = bgp.EC_SUBTYPE_ROUTE_TARGET
+	case "soo":
+		st = bgp.EC_SUBTYPE_ROUTE_ORIGIN
+	default:
+		return nil, fmt.Errorf("unknown extended community type '%s' in '%s'", t[0], s)
+	}
+
+	if c, err = bgp.ParseExtendedCommunity(st, t[1]); err != nil {
+		return nil, fmt.Errorf("unable to parse '%s' as extended community: %w", s, err)
+	}
+
+	return
+}
+
+// communityAttrs builds the path attributes carrying the union of the given communities
+func communityAttrs(cs ...*bgpCommunities) (as []*any.Any, err error) {
+	std := &api.CommunitiesAttribute{}
+	large := &api.LargeCommunitiesAttribute{}
+	ext := []bgp.ExtendedCommunityInterface{}
+
+	for _, c := range cs {
+		for _, s := range c.Communities {
+			v, err := parseCommunity(s)
+			if err != nil {
+				return nil, err
+			}
+
+			std.Communities = append(std.Communities, v)
+		}
+
+		for _, s := range c.LargeCommunities {
+			v, err := bgp.ParseLargeCommunity(s)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse '%s' as large community: %w", s, err)
+			}
+
+			large.Communities = append(large.Communities, &api.LargeCommunity{
+				GlobalAdmin: v.ASN,
+				LocalData1:  v.LocalData1,
+				LocalData2:  v.LocalData2,
+			})
+		}
+
+		for _, s := range c.ExtCommunities {
+			v, err := parseExtCommunity(s)
+			if err != nil {
+				return nil, err
+			}
+
+			ext = append(ext, v)
+		}
+	}
+
+	if len(std.Communities) > 0 {
+		a, _ := anypb.New(std)
+		as = append(as, a)
+	}
+
+	if len(large.Communities) > 0 {
+		a, _ := anypb.New(large)
+		as = append(as, a)
+	}
+
+	if len(ext) > 0 {
+		e, err := apiutil.NewExtendedCommunitiesAttributeFromNative(bgp.NewPathAttributeExtendedCommunities(ext))
+		if err != nil {
+			return nil, err
+		}
+
+		a, _ := anypb.New(e)
+		as = append(as, a)
+	}
+
+	return
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseCommunity(t *testing.T) {
+	c := map[string]uint32{
+		"65000:100": 65000<<16 | 100,
+		"12345":     12345,
+		"no-export": 0xffffff01,
+	}
+
+	for k, v := range c {
+		r, err := parseCommunity(k)
+		assert.Nil(t, err)
+		assert.Equal(t, v, r)
+	}
+
+	for _, k := range []string{"70000:1", "foo", "1:2:3"} {
+		_, err := parseCommunity(k)
+		assert.NotNil(t, err)
+	}
+}
+
+func Test_communityAttrs(t *testing.T) {
+	as, err := communityAttrs(
+		&bgpCommunities{
+			Communities:      []string{"65000:100"},
+			LargeCommunities: []string{"65000:1:2"},
+		},
+		&bgpCommunities{
+			Communities:    []string{"65000:200"},
+			ExtCommunities: []string{"rt:65000:300", "soo:10.0.0.1:1"},
+		},
+	)
+	assert.Nil(t, err)
+	assert.Len(t, as, 3)
+
+	std := &api.CommunitiesAttribute{}
+	assert.Nil(t, as[0].UnmarshalTo(std))
+	assert.Equal(t, []uint32{65000<<16 | 100, 65000<<16 | 200}, std.Communities)
+
+	large := &api.LargeCommunitiesAttribute{}
+	assert.Nil(t, as[1].UnmarshalTo(large))
+	assert.Equal(t, uint32(65000), large.Communities[0].GlobalAdmin)
+	assert.Equal(t, uint32(2), large.Communities[0].LocalData2)
+
+	ext := &api.ExtendedCommunitiesAttribute{}
+	assert.Nil(t, as[2].UnmarshalTo(ext))
+	assert.Len(t, ext.Communities, 2)
+
+	as, err = communityAttrs(&bgpCommunities{})
+	assert.Nil(t, err)
+	assert.Len(t, as, 0)
+
+	_, err = communityAttrs(&bgpCommunities{ExtCommunities: []string{"foo:1:2"}})
+	assert.NotNil(t, err)
+}
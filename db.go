@@ -2,20 +2,28 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
-	"net"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
 type db struct {
-	h *bolt.DB
-	b []byte
+	h  *bolt.DB
+	b  []byte
+	bs []byte
+	bc []byte
 }
 
+// The change log bucket has the epoch under this key and the changes by their 8-byte sequence numbers
+var keyEpoch = []byte("epoch")
+
 func newDB(path string) (d *db, err error) {
 	d = &db{
-		b: []byte("ipcache"),
+		b:  []byte("ipcache"),
+		bs: []byte("syncstate"),
+		bc: []byte("changes"),
 	}
 
 	if d.h, err = bolt.Open(path, 0666, nil); err != nil {
@@ -23,33 +31,114 @@ func newDB(path string) (d *db, err error) {
 	}
 
 	return d, d.h.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(d.b)
-		return err
+		for _, n := range [][]byte{d.bs, d.bc} {
+			if _, err := tx.CreateBucketIfNotExists(n); err != nil {
+				return err
+			}
+		}
+
+		b, err := tx.CreateBucketIfNotExists(d.b)
+		if err != nil {
+			return err
+		}
+
+		return d.migrate(b)
 	})
 }
 
-func (d *db) add(e *cacheEntry) (err error) {
+// dbKey is the 16-byte IP followed by the domain, one record per reference
+func dbKey(e *cacheEntry) []byte {
+	return append(append([]byte{}, e.IP.To16()...), e.Domain...)
+}
+
+func encodeEntry(e *cacheEntry) ([]byte, error) {
 	var b bytes.Buffer
-	if err = gob.NewEncoder(&b).Encode(e); err != nil {
+	if err := gob.NewEncoder(&b).Encode(e); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func decodeEntry(v []byte) (e *cacheEntry, err error) {
+	e = &cacheEntry{}
+	err = gob.NewDecoder(bytes.NewBuffer(v)).Decode(e)
+	return
+}
+
+// migrate re-keys the records stored by IP only by the older versions
+func (d *db) migrate(b *bolt.Bucket) (err error) {
+	old := map[string]*cacheEntry{}
+	if err = b.ForEach(func(k, v []byte) error {
+		e, err := decodeEntry(v)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(k, dbKey(e)) {
+			old[string(k)] = e
+		}
+
+		return nil
+	}); err != nil {
 		return
 	}
 
-	return d.h.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(d.b).Put(e.IP, b.Bytes())
+	for k, e := range old {
+		v, err := encodeEntry(e)
+		if err != nil {
+			return err
+		}
+
+		if err = b.Delete([]byte(k)); err != nil {
+			return err
+		}
+
+		if err = b.Put(dbKey(e), v); err != nil {
+			return err
+		}
+	}
+
+	return
+}
+
+func (d *db) add(e *cacheEntry) (err error) {
+	v, err := encodeEntry(e)
+	if err != nil {
+		return
+	}
+
+	return d.update("add", func(b *bolt.Bucket) error {
+		return b.Put(dbKey(e), v)
 	})
 }
 
-func (d *db) del(ip net.IP) (err error) {
-	return d.h.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(d.b).Delete(ip)
+func (d *db) del(e *cacheEntry) (err error) {
+	return d.update("delete", func(b *bolt.Bucket) error {
+		return b.Delete(dbKey(e))
 	})
 }
 
+// update runs fn in a write transaction and records its latency and errors
+func (d *db) update(op string, fn func(*bolt.Bucket) error) (err error) {
+	t := time.Now()
+	err = d.h.Update(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(d.b))
+	})
+
+	mDBWrite.Observe(time.Since(t).Seconds())
+	if err != nil {
+		mDBErrors.WithLabelValues(op).Inc()
+	}
+
+	return
+}
+
 func (d *db) fetchAll() (es []*cacheEntry, err error) {
 	err = d.h.View(func(tx *bolt.Tx) error {
 		return tx.Bucket(d.b).ForEach(func(k, v []byte) (err error) {
-			e := &cacheEntry{}
-			if err = gob.NewDecoder(bytes.NewBuffer(v)).Decode(e); err != nil {
+			e, err := decodeEntry(v)
+			if err != nil {
 				return err
 			}
 
@@ -61,6 +150,144 @@ func (d *db) fetchAll() (es []*cacheEntry, err error) {
 	return es, err
 }
 
+func (d *db) loadSyncStates() (m map[string]*syncState, err error) {
+	m = map[string]*syncState{}
+	err = d.h.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(d.bs).ForEach(func(k, v []byte) error {
+			st := &syncState{}
+			if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(st); err != nil {
+				return err
+			}
+
+			m[string(k)] = st
+			return nil
+		})
+	})
+
+	return
+}
+
+func (d *db) saveSyncState(peer string, st *syncState) (err error) {
+	var b bytes.Buffer
+	if err = gob.NewEncoder(&b).Encode(st); err != nil {
+		return
+	}
+
+	return d.h.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(d.bs).Put([]byte(peer), b.Bytes())
+	})
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// loadChanges reads the last consecutive changes and drops the older ones
+func (d *db) loadChanges(max int) (epoch string, seq uint64, es []*cacheEntry, err error) {
+	err = d.h.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(d.bc)
+		epoch = string(b.Get(keyEpoch))
+
+		old := [][]byte{}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if len(k) != 8 {
+				continue
+			}
+
+			s := binary.BigEndian.Uint64(k)
+			if len(es) == 0 {
+				seq = s
+			}
+
+			if len(es) == max || s != seq-uint64(len(es)) {
+				old = append(old, k)
+				continue
+			}
+
+			e, err := decodeEntry(v)
+			if err != nil {
+				return err
+			}
+
+			es = append(es, e)
+		}
+
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	// Oldest first
+	for i, j := 0, len(es)-1; i < j; i, j = i+1, j-1 {
+		es[i], es[j] = es[j], es[i]
+	}
+
+	return
+}
+
+func (d *db) saveEpoch(epoch string) error {
+	return d.h.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(d.bc).Put(keyEpoch, []byte(epoch))
+	})
+}
+
+func (d *db) saveChanges(last uint64, es []*cacheEntry, size int) (err error) {
+	first := last - uint64(len(es)) + 1
+
+	vs := make([][]byte, len(es))
+	for i, e := range es {
+		if vs[i], err = encodeEntry(e); err != nil {
+			return
+		}
+	}
+
+	err = d.h.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(d.bc)
+
+		// Drop the changes which fell out of the log, including the ones left by a failed write
+		old := [][]byte{}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if len(k) != 8 {
+				continue
+			}
+
+			if binary.BigEndian.Uint64(k)+uint64(size) > last {
+				break
+			}
+
+			old = append(old, k)
+		}
+
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		for i, v := range vs {
+			if err := b.Put(seqKey(first+uint64(i)), v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		mDBErrors.WithLabelValues("change").Inc()
+	}
+
+	return
+}
+
 func (d *db) close() error {
 	return d.h.Close()
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 )
 
 func Test_DB(t *testing.T) {
@@ -15,10 +16,12 @@ func Test_DB(t *testing.T) {
 	db, err := newDB(f)
 	assert.Nil(t, err)
 
+	now := time.Now()
 	e := &cacheEntry{
-		IP:     net.ParseIP("1.2.3.4"),
-		Domain: "test.foo",
-		TS:     time.Now(),
+		IP:      net.ParseIP("1.2.3.4"),
+		Domain:  "test.foo",
+		TS:      now,
+		Expires: now.Add(time.Hour),
 	}
 
 	err = db.add(e)
@@ -28,9 +31,79 @@ func Test_DB(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, ee[0].Domain, e.Domain)
 	assert.Equal(t, ee[0].IP, e.IP)
+	assert.True(t, ee[0].Expires.Equal(e.Expires))
+
+	e2 := &cacheEntry{
+		IP:     e.IP,
+		Domain: "foo.test",
+		TS:     now,
+	}
+
+	err = db.add(e2)
+	assert.Nil(t, err)
+
+	ee, err = db.fetchAll()
+	assert.Nil(t, err)
+	assert.Len(t, ee, 2)
+
+	err = db.del(e)
+	assert.Nil(t, err)
+
+	ee, err = db.fetchAll()
+	assert.Nil(t, err)
+	assert.Len(t, ee, 1)
+	assert.Equal(t, "foo.test", ee[0].Domain)
+
+	st := &syncState{Epoch: "foo", Seq: 123}
+	err = db.saveSyncState("127.0.0.1:8080", st)
+	assert.Nil(t, err)
+
+	sts, err := db.loadSyncStates()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]*syncState{"127.0.0.1:8080": st}, sts)
+
+	err = db.close()
+	assert.Nil(t, err)
+	os.Remove(f)
+}
+
+func Test_DBMigrate(t *testing.T) {
+	f := "__test.db"
+
+	e := &cacheEntry{
+		IP:     net.ParseIP("1.2.3.4"),
+		Domain: "test.foo",
+		TS:     time.Now(),
+	}
+
+	h, err := bolt.Open(f, 0666, nil)
+	assert.Nil(t, err)
 
-	err = db.del(e.IP)
+	err = h.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("ipcache"))
+		if err != nil {
+			return err
+		}
+
+		v, err := encodeEntry(e)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(e.IP, v)
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, h.Close())
+
+	db, err := newDB(f)
+	assert.Nil(t, err)
+
+	err = db.del(e)
+	assert.Nil(t, err)
+
+	ee, err := db.fetchAll()
 	assert.Nil(t, err)
+	assert.Len(t, ee, 0)
 
 	err = db.close()
 	assert.Nil(t, err)
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	dnstap "github.com/dnstap/golang-dnstap"
 	"github.com/miekg/dns"
@@ -16,25 +22,129 @@ type dnstapCfg struct {
 	Listen string
 	Perm   string
 	IPv6   bool
+
+	// Message types to take the replies from, CLIENT_RESPONSE by default
+	Types []string
+
+	// Stored in the cache entries, the lists can be limited to the replies with certain tags
+	Tag string
+
+	// Accept the TCP connections only over TLS, set ClientAuth to verify the clients' certificates
+	TLS *tlsCfg
+
+	// Accept the TCP connections only from these prefixes
+	Allow []string
 }
 
+var (
+	// How long a TCP client has to complete the TLS and the frame stream handshakes
+	dnstapHandshakeTimeout = 10 * time.Second
+
+	errNotAllowed = errors.New("source address is not allowed")
+)
+
+// dnsEntry is an IP from the reply along with the CNAME chain which led to it:
+// from the queried name to the owner of the A/AAAA record
 type dnsEntry struct {
-	ip   net.IP
-	fqdn string
+	ip    net.IP
+	ttl   uint32
+	chain []string
+	// Where the reply came from: "dnstap" or "proxy", and the tag of the listener
+	source string
+	tag    string
 }
 
-type fCb func(net.IP, string)
+// fCb is called for every address in the reply, returns true if it matched
+type fCb func(*dnsEntry) bool
 type fCbErr func(error)
 
 type dnstapServer struct {
 	cfg         *dnstapCfg
 	cb          fCb
 	cbErr       fCbErr
+	types       map[dnstap.Message_Type]bool
 	fstrmServer *dnstap.FrameStreamSockInput
 	l           net.Listener
 	ch          chan []byte
 }
 
+// dnstapListener accepts only the connections from the allowed prefixes
+// and, if TLS is configured, wraps them to verify the clients before the frame stream starts,
+// so that the frames from unauthorized clients never reach the decoder
+type dnstapListener struct {
+	net.Listener
+	allow []*net.IPNet
+	tls   *tls.Config
+}
+
+func (l *dnstapListener) reject(c net.Conn, reason string, err error) {
+	mDnstapRejected.WithLabelValues(reason).Inc()
+	log.Printf("DNSTap: rejected connection from %s: %s", c.RemoteAddr(), err)
+	c.Close()
+}
+
+func (l *dnstapListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(l.allow) > 0 {
+			if a, ok := c.RemoteAddr().(*net.TCPAddr); !ok || !containsIP(l.allow, a.IP) {
+				l.reject(c, "address", errNotAllowed)
+				continue
+			}
+		}
+
+		if l.tls == nil {
+			return c, nil
+		}
+
+		// The connections are accepted one by one, so the handshake is left for the first read or write
+		return &dnstapTLSConn{Conn: tls.Server(c, l.tls), l: l}, nil
+	}
+}
+
+// dnstapTLSConn completes the TLS handshake on the first read or write
+// within the timeout and rejects the connection if it fails
+type dnstapTLSConn struct {
+	*tls.Conn
+	l    *dnstapListener
+	once sync.Once
+	err  error
+}
+
+func (c *dnstapTLSConn) handshake() error {
+	c.once.Do(func() {
+		c.Conn.SetDeadline(time.Now().Add(dnstapHandshakeTimeout))
+		if c.err = c.Conn.Handshake(); c.err != nil {
+			c.l.reject(c.Conn, "tls", c.err)
+			return
+		}
+
+		c.Conn.SetDeadline(time.Time{})
+	})
+
+	return c.err
+}
+
+func (c *dnstapTLSConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *dnstapTLSConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(b)
+}
+
 /*
 ch-odc.samsungapps.com.                                             300     IN      CNAME   ch-odc.gw.samsungapps.com.
 ch-odc.gw.samsungapps.com.                                          10      IN      CNAME   fe-pew1-ext-s3store-elb-1085125128.eu-west-1.elb.amazonaws.com.
@@ -42,35 +152,49 @@ fe-pew1-ext-s3store-elb-1085125128.eu-west-1.elb.amazonaws.com.     60      IN
 */
 
 func parseDNSReply(m *dns.Msg, ipv6 bool) []*dnsEntry {
-	var domain string
+	var chain []string
 	result := []*dnsEntry{}
 
+	entry := func(ip net.IP, hdr *dns.RR_Header) *dnsEntry {
+		if len(chain) == 0 {
+			chain = append(chain, hdr.Name)
+		}
+
+		c := []string{}
+		for _, n := range chain {
+			c = append(c, n)
+			if n == hdr.Name {
+				break
+			}
+		}
+
+		if c[len(c)-1] != hdr.Name {
+			c = append(c, hdr.Name)
+		}
+
+		return &dnsEntry{ip: ip, ttl: hdr.Ttl, chain: c}
+	}
+
 	for _, rr := range m.Answer {
 		hdr := rr.Header()
 
 		switch rv := rr.(type) {
 		case *dns.CNAME:
-			if domain == "" {
-				domain = hdr.Name
+			if len(chain) == 0 {
+				chain = append(chain, hdr.Name)
 			}
 
-		case *dns.A:
-			if domain == "" {
-				domain = hdr.Name
-			}
+			chain = append(chain, rv.Target)
 
-			result = append(result, &dnsEntry{rv.A, domain})
+		case *dns.A:
+			result = append(result, entry(rv.A, hdr))
 
 		case *dns.AAAA:
 			if !ipv6 {
 				break
 			}
 
-			if domain == "" {
-				domain = hdr.Name
-			}
-
-			result = append(result, &dnsEntry{rv.AAAA, domain})
+			result = append(result, entry(rv.AAAA, hdr))
 		}
 	}
 
@@ -78,26 +202,61 @@ func parseDNSReply(m *dns.Msg, ipv6 bool) []*dnsEntry {
 }
 
 func (ds *dnstapServer) handleDNSMsg(m *dns.Msg) {
-	for _, d := range parseDNSReply(m, ds.cfg.IPv6) {
-		ds.cb(d.ip, d.fqdn[:len(d.fqdn)-1])
+	handleReply(m, ds.cfg.IPv6, "dnstap", ds.cfg.Tag, ds.cb)
+}
+
+// handleReply passes the addresses from the reply to the callback
+func handleReply(m *dns.Msg, ipv6 bool, source, tag string, cb fCb) {
+	es := parseDNSReply(m, ipv6)
+	if len(es) == 0 {
+		return
+	}
+
+	matched := false
+	for _, d := range es {
+		d.source, d.tag = source, tag
+		for i, n := range d.chain {
+			d.chain[i] = strings.TrimSuffix(n, ".")
+		}
+
+		if cb(d) {
+			matched = true
+		}
+	}
+
+	if matched {
+		mReplies.WithLabelValues(source, "matched").Inc()
+	} else {
+		mReplies.WithLabelValues(source, "unmatched").Inc()
 	}
 }
 
 func (ds *dnstapServer) ProcessProtobuf() {
 	for frame := range ds.ch {
+		mDnstapFrames.Inc()
+
 		tap := &dnstap.Dnstap{}
 		if err := proto.Unmarshal(frame, tap); err != nil {
+			mDnstapErrors.WithLabelValues("unmarshal").Inc()
 			ds.cbErr(fmt.Errorf("unmarshal failed: %w", err))
 			continue
 		}
 
 		msg := tap.Message
-		if msg.GetType() != dnstap.Message_CLIENT_RESPONSE {
+		if msg == nil {
+			continue
+		}
+
+		if !ds.types[msg.GetType()] {
+			mDnstapMessages.WithLabelValues(msg.GetType().String(), "ignored").Inc()
 			continue
 		}
 
+		mDnstapMessages.WithLabelValues(msg.GetType().String(), "accepted").Inc()
+
 		dnsMsg := new(dns.Msg)
 		if err := dnsMsg.Unpack(msg.ResponseMessage); err != nil {
+			mDnstapErrors.WithLabelValues("unpack").Inc()
 			ds.cbErr(fmt.Errorf("unpack failed: %w", err))
 			continue
 		}
@@ -106,6 +265,32 @@ func (ds *dnstapServer) ProcessProtobuf() {
 	}
 }
 
+// parseMessageTypes parses the names of the response message types
+func parseMessageTypes(names []string) (types map[dnstap.Message_Type]bool, err error) {
+	if len(names) == 0 {
+		names = []string{"CLIENT_RESPONSE"}
+	}
+
+	types = map[dnstap.Message_Type]bool{}
+	for _, n := range names {
+		n = strings.ToUpper(n)
+
+		v, ok := dnstap.Message_Type_value[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown DNSTap message type '%s'", n)
+		}
+
+		// All responses carry the reply in the same field, the queries have no answers
+		if !strings.HasSuffix(n, "_RESPONSE") {
+			return nil, fmt.Errorf("DNSTap message type '%s' is not a response", n)
+		}
+
+		types[dnstap.Message_Type(v)] = true
+	}
+
+	return
+}
+
 func newDnstapServer(c *dnstapCfg, cb fCb, cbErr fCbErr) (ds *dnstapServer, err error) {
 	ds = &dnstapServer{
 		cfg:   c,
@@ -118,13 +303,35 @@ func newDnstapServer(c *dnstapCfg, cb fCb, cbErr fCbErr) (ds *dnstapServer, err
 		return nil, fmt.Errorf("you need to specify DNSTap listening poing")
 	}
 
+	if ds.types, err = parseMessageTypes(c.Types); err != nil {
+		return nil, err
+	}
+
 	if addr, err := net.ResolveTCPAddr("tcp", c.Listen); err == nil {
-		if ds.l, err = net.ListenTCP("tcp", addr); err != nil {
+		l := &dnstapListener{}
+		if l.allow, err = parsePrefixes(c.Allow); err != nil {
+			return nil, fmt.Errorf("unable to parse allowed prefixes: %w", err)
+		}
+
+		if c.TLS != nil {
+			if l.tls, err = c.TLS.serverConfig(); err != nil {
+				return nil, err
+			}
+		}
+
+		if l.Listener, err = net.ListenTCP("tcp", addr); err != nil {
 			return nil, fmt.Errorf("unable to listen on '%s': %w", c.Listen, err)
 		}
 
+		ds.l = l
 		ds.fstrmServer = dnstap.NewFrameStreamSockInput(ds.l)
+		// The connections are accepted one by one, so a silent client shouldn't stall the others for long
+		ds.fstrmServer.SetTimeout(dnstapHandshakeTimeout)
 	} else {
+		if c.TLS != nil || len(c.Allow) > 0 {
+			return nil, fmt.Errorf("TLS and allowed prefixes are supported only for TCP")
+		}
+
 		ds.fstrmServer, err = dnstap.NewFrameStreamSockInputFromPath(c.Listen)
 		if err != nil {
 			return nil, fmt.Errorf("unable to listen on '%s': %w", c.Listen, err)
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 
+	"github.com/BurntSushi/toml"
 	dnstap "github.com/dnstap/golang-dnstap"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -47,6 +53,7 @@ func Test_ParseDNSReply(t *testing.T) {
 			&dns.A{
 				Hdr: dns.RR_Header{
 					Name: "mqtt-mini.c10r.facebook.com.",
+					Ttl:  60,
 				},
 
 				A: net.ParseIP("157.240.17.34"),
@@ -65,45 +72,48 @@ func Test_ParseDNSReply(t *testing.T) {
 	r := parseDNSReply(msg1, false)
 	assert.Equal(t, []*dnsEntry{
 		{
-			fqdn: "mqtt-mini.facebook.com.",
-			ip:   net.ParseIP("157.240.17.34"),
+			ip:    net.ParseIP("157.240.17.34"),
+			chain: []string{"mqtt-mini.facebook.com.", "mqtt-mini.c10r.facebook.com."},
 		},
 	}, r)
 
 	r = parseDNSReply(msg1, true)
 	assert.Equal(t, []*dnsEntry{
 		{
-			fqdn: "mqtt-mini.facebook.com.",
-			ip:   net.ParseIP("157.240.17.34"),
+			ip:    net.ParseIP("157.240.17.34"),
+			chain: []string{"mqtt-mini.facebook.com.", "mqtt-mini.c10r.facebook.com."},
 		},
 		{
-			fqdn: "mqtt-mini.facebook.com.",
-			ip:   net.ParseIP("2a03:2880:f15b:84:face:b00c:0:1ea0"),
+			ip:    net.ParseIP("2a03:2880:f15b:84:face:b00c:0:1ea0"),
+			chain: []string{"mqtt-mini.facebook.com.", "mqtt-mini.c10r.facebook.com."},
 		},
 	}, r)
 
 	r = parseDNSReply(msg2, true)
 	assert.Equal(t, []*dnsEntry{
 		{
-			fqdn: "mqtt-mini.c10r.facebook.com.",
-			ip:   net.ParseIP("157.240.17.34"),
+			ip:    net.ParseIP("157.240.17.34"),
+			ttl:   60,
+			chain: []string{"mqtt-mini.c10r.facebook.com."},
 		},
 		{
-			fqdn: "mqtt-mini.c10r.facebook.com.",
-			ip:   net.ParseIP("2a03:2880:f15b:84:face:b00c:0:1ea0"),
+			ip:    net.ParseIP("2a03:2880:f15b:84:face:b00c:0:1ea0"),
+			chain: []string{"mqtt-mini.c10r.facebook.com."},
 		},
 	}, r)
 }
 
 func Test_DNSTap(t *testing.T) {
 	ip, domain := net.ParseIP("1.2.3.4"), "test.foo."
-	ip2, domain2 := net.IP{}, ""
+	ip2, domain2, chain2 := net.IP{}, "", []string{}
 
 	ch := make(chan struct{})
-	cb := func(i net.IP, d string) {
-		ip2 = i
-		domain2 = d
+	cb := func(d *dnsEntry) bool {
+		ip2 = d.ip
+		domain2 = d.chain[0]
+		chain2 = d.chain
 		close(ch)
+		return true
 	}
 
 	var err2 error
@@ -158,7 +168,250 @@ func Test_DNSTap(t *testing.T) {
 	<-ch
 	assert.Nil(t, err2)
 	assert.Equal(t, "test.foo", domain2)
+	assert.Equal(t, []string{"test.foo"}, chain2)
 	assert.Equal(t, ip.To4(), ip2)
 
 	os.Remove("dnstap.sock")
 }
+
+func Test_parseMessageTypes(t *testing.T) {
+	ts, err := parseMessageTypes(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[dnstap.Message_Type]bool{dnstap.Message_CLIENT_RESPONSE: true}, ts)
+
+	ts, err = parseMessageTypes([]string{"resolver_response", "FORWARDER_RESPONSE"})
+	assert.Nil(t, err)
+	assert.True(t, ts[dnstap.Message_RESOLVER_RESPONSE])
+	assert.True(t, ts[dnstap.Message_FORWARDER_RESPONSE])
+	assert.False(t, ts[dnstap.Message_CLIENT_RESPONSE])
+
+	_, err = parseMessageTypes([]string{"FOO_RESPONSE"})
+	assert.NotNil(t, err)
+	_, err = parseMessageTypes([]string{"CLIENT_QUERY"})
+	assert.NotNil(t, err)
+}
+
+// tapFrame encodes a DNSTap message of the type with a reply resolving the domain
+func tapFrame(t *testing.T, typ dnstap.Message_Type, ip net.IP, domain string) []byte {
+	dmsg := &dns.Msg{
+		Answer: []dns.RR{
+			&dns.A{
+				A:   ip,
+				Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeA},
+			},
+		},
+	}
+
+	b, err := dmsg.Pack()
+	assert.Nil(t, err)
+
+	dt := dnstap.Dnstap_MESSAGE
+	b, err = proto.Marshal(&dnstap.Dnstap{
+		Type: &dt,
+		Message: &dnstap.Message{
+			Type:            &typ,
+			ResponseMessage: b,
+		},
+	})
+
+	assert.Nil(t, err)
+	return b
+}
+
+func Test_DNSTapTypes(t *testing.T) {
+	ch := make(chan string, 2)
+	cb := func(d *dnsEntry) bool {
+		ch <- d.tag + " " + d.chain[0]
+		return true
+	}
+
+	_, err := newDnstapServer(&dnstapCfg{
+		Listen: "dnstap-types.sock",
+		Types:  []string{"RESOLVER_RESPONSE"},
+		Tag:    "site",
+	}, cb, func(error) {})
+	assert.Nil(t, err)
+	defer os.Remove("dnstap-types.sock")
+
+	addr, err := net.ResolveUnixAddr("unix", "dnstap-types.sock")
+	assert.Nil(t, err)
+
+	out, err := dnstap.NewFrameStreamSockOutput(addr)
+	assert.Nil(t, err)
+	go out.RunOutputLoop()
+
+	ignored := testutil.ToFloat64(mDnstapMessages.WithLabelValues("CLIENT_RESPONSE", "ignored"))
+	accepted := testutil.ToFloat64(mDnstapMessages.WithLabelValues("RESOLVER_RESPONSE", "accepted"))
+
+	out.GetOutputChannel() <- tapFrame(t, dnstap.Message_CLIENT_RESPONSE, net.ParseIP("1.2.3.4"), "client.foo.")
+	out.GetOutputChannel() <- tapFrame(t, dnstap.Message_RESOLVER_RESPONSE, net.ParseIP("1.2.3.4"), "resolver.foo.")
+	out.Close()
+
+	assert.Equal(t, "site resolver.foo", <-ch)
+
+	// The frames are processed concurrently
+	for i := 0; i < 100 && testutil.ToFloat64(mDnstapMessages.WithLabelValues("CLIENT_RESPONSE", "ignored")) == ignored; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, ignored+1, testutil.ToFloat64(mDnstapMessages.WithLabelValues("CLIENT_RESPONSE", "ignored")))
+	assert.Equal(t, accepted+1, testutil.ToFloat64(mDnstapMessages.WithLabelValues("RESOLVER_RESPONSE", "accepted")))
+	assert.Len(t, ch, 0)
+}
+
+func Test_dnstapCfgs(t *testing.T) {
+	decode := func(s string) ([]*dnstapCfg, error) {
+		cfg := &cfgRoot{}
+		md, err := toml.Decode(s, cfg)
+		assert.Nil(t, err)
+		return cfg.dnstapCfgs(md)
+	}
+
+	cfs, err := decode("[dnstap]\nlisten = \"/tmp/dnstap.sock\"\n")
+	assert.Nil(t, err)
+	assert.Len(t, cfs, 1)
+	assert.Equal(t, "/tmp/dnstap.sock", cfs[0].Listen)
+
+	cfs, err = decode("[[dnstap]]\nlisten = \"/tmp/dnstap.sock\"\n[[dnstap]]\nlisten = \"0.0.0.0:1234\"\ntag = \"remote\"\ntypes = [\"RESOLVER_RESPONSE\"]\n")
+	assert.Nil(t, err)
+	assert.Len(t, cfs, 2)
+	assert.Equal(t, "remote", cfs[1].Tag)
+	assert.Equal(t, []string{"RESOLVER_RESPONSE"}, cfs[1].Types)
+
+	cfs, err = decode("")
+	assert.Nil(t, err)
+	assert.Len(t, cfs, 0)
+
+	_, err = decode("dnstap = 1\n")
+	assert.NotNil(t, err)
+}
+
+func Test_DNSTapTLS(t *testing.T) {
+	dir := genTLS(t)
+	f := func(n string) string { return filepath.Join(dir, n) }
+
+	ch := make(chan string, 1)
+	cb := func(d *dnsEntry) bool {
+		ch <- d.chain[0]
+		return true
+	}
+
+	_, err := newDnstapServer(&dnstapCfg{
+		Listen: "dnstap.sock",
+		TLS:    &tlsCfg{Cert: f("server.crt"), Key: f("server.key")},
+	}, cb, func(error) {})
+	assert.NotNil(t, err)
+
+	_, err = newDnstapServer(&dnstapCfg{
+		Listen: "127.0.0.1:0",
+		Allow:  []string{"foo"},
+	}, cb, func(error) {})
+	assert.NotNil(t, err)
+
+	ds, err := newDnstapServer(&dnstapCfg{
+		Listen: "127.0.0.1:0",
+		TLS:    &tlsCfg{Cert: f("server.crt"), Key: f("server.key"), CA: f("ca.crt"), ClientAuth: true},
+	}, cb, func(error) {})
+	assert.Nil(t, err)
+	addr := ds.l.Addr().String()
+
+	send := func(c *tlsCfg, domain string) error {
+		ctc, err := c.clientConfig()
+		assert.Nil(t, err)
+
+		conn, err := tls.Dial("tcp", addr, ctc)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		w, err := dnstap.NewWriter(conn, &dnstap.WriterOptions{Bidirectional: true, Timeout: time.Second})
+		if err != nil {
+			return err
+		}
+
+		if _, err = w.WriteFrame(tapFrame(t, dnstap.Message_CLIENT_RESPONSE, net.ParseIP("1.2.3.4"), domain)); err != nil {
+			return err
+		}
+
+		return w.Close()
+	}
+
+	rejected := testutil.ToFloat64(mDnstapRejected.WithLabelValues("tls"))
+
+	assert.Nil(t, send(&tlsCfg{Cert: f("client.crt"), Key: f("client.key"), CA: f("ca.crt")}, "tls.foo."))
+	assert.Equal(t, "tls.foo", <-ch)
+
+	// No client certificate
+	assert.NotNil(t, send(&tlsCfg{CA: f("ca.crt")}, "notls.foo."))
+	assert.Equal(t, rejected+1, testutil.ToFloat64(mDnstapRejected.WithLabelValues("tls")))
+
+	// Not allowed address
+	ds, err = newDnstapServer(&dnstapCfg{
+		Listen: "127.0.0.1:0",
+		Allow:  []string{"10.0.0.0/8"},
+	}, cb, func(error) {})
+	assert.Nil(t, err)
+
+	rejected = testutil.ToFloat64(mDnstapRejected.WithLabelValues("address"))
+
+	conn, err := net.Dial("tcp", ds.l.Addr().String())
+	assert.Nil(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	conn.Close()
+
+	assert.Equal(t, rejected+1, testutil.ToFloat64(mDnstapRejected.WithLabelValues("address")))
+	assert.Len(t, ch, 0)
+}
+
+func Test_DNSTapSilentClient(t *testing.T) {
+	dir := genTLS(t)
+	f := func(n string) string { return filepath.Join(dir, n) }
+
+	timeout := dnstapHandshakeTimeout
+	dnstapHandshakeTimeout = 500 * time.Millisecond
+	defer func() { dnstapHandshakeTimeout = timeout }()
+
+	ch := make(chan string, 1)
+	cb := func(d *dnsEntry) bool {
+		ch <- d.chain[0]
+		return true
+	}
+
+	ds, err := newDnstapServer(&dnstapCfg{
+		Listen: "127.0.0.1:0",
+		TLS:    &tlsCfg{Cert: f("server.crt"), Key: f("server.key")},
+	}, cb, func(error) {})
+	assert.Nil(t, err)
+	addr := ds.l.Addr().String()
+
+	rejected := testutil.ToFloat64(mDnstapRejected.WithLabelValues("tls"))
+
+	// Connects and sends nothing
+	silent, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer silent.Close()
+
+	ctc, err := (&tlsCfg{CA: f("ca.crt")}).clientConfig()
+	assert.Nil(t, err)
+
+	conn, err := tls.Dial("tcp", addr, ctc)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	w, err := dnstap.NewWriter(conn, &dnstap.WriterOptions{Bidirectional: true, Timeout: 5 * time.Second})
+	assert.Nil(t, err)
+	_, err = w.WriteFrame(tapFrame(t, dnstap.Message_CLIENT_RESPONSE, net.ParseIP("1.2.3.4"), "after.foo."))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	select {
+	case d := <-ch:
+		assert.Equal(t, "after.foo", d)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client after the silent one wasn't served")
+	}
+
+	assert.Equal(t, rejected+1, testutil.ToFloat64(mDnstapRejected.WithLabelValues("tls")))
+}
@@ -125,3 +125,79 @@ func newDomainTree() (d *domainTree) {
 
 	return
 }
+
+type domainList struct {
+	name string
+	path string
+	t    *domainTree
+	// The list applies only to the replies from the listeners with these tags, to all if empty
+	tags map[string]bool
+}
+
+// domainLists is an ordered set of named lists, the first matching list wins
+type domainLists []*domainList
+
+// match returns the first list which has the name and applies to the tag
+func (d domainLists) match(s, tag string) (list string, ok bool) {
+	for _, l := range d {
+		if len(l.tags) > 0 && !l.tags[tag] {
+			continue
+		}
+
+		if l.t.has(s) {
+			return l.name, true
+		}
+	}
+
+	return "", false
+}
+
+// matchChain returns the first name of the chain which matches any list applying to the tag
+func (d domainLists) matchChain(names []string, tag string) (name, list string, ok bool) {
+	for _, name = range names {
+		if list, ok = d.match(name, tag); ok {
+			return
+		}
+	}
+
+	return "", "", false
+}
+
+func (d domainLists) loadFiles() (i, s int, err error) {
+	for _, l := range d {
+		ii, ss, err := l.t.loadFile(l.path)
+		if err != nil {
+			return i, s, fmt.Errorf("list '%s': %w", l.name, err)
+		}
+
+		i, s = i+ii, s+ss
+	}
+
+	return
+}
+
+func (d domainLists) count() (n int) {
+	for _, l := range d {
+		n += l.t.count()
+	}
+
+	return
+}
+
+func (d domainLists) add(name, path string, tags ...string) domainLists {
+	l := &domainList{
+		name: name,
+		path: path,
+		t:    newDomainTree(),
+	}
+
+	for _, t := range tags {
+		if l.tags == nil {
+			l.tags = map[string]bool{}
+		}
+
+		l.tags[t] = true
+	}
+
+	return append(d, l)
+}
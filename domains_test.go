@@ -44,3 +44,56 @@ func Test_domainTree(t *testing.T) {
 func Test_domainLevel(t *testing.T) {
 	assert.Equal(t, 5, domainLevel("a.b.c.d.e"))
 }
+
+func Test_domainLists(t *testing.T) {
+	f1, f2 := "__test1.txt", "__test2.txt"
+	err := os.WriteFile(f1, []byte("facebook.com\n"), 0666)
+	assert.Nil(t, err)
+	err = os.WriteFile(f2, []byte("api.facebook.com\nyoutube.com\n"), 0666)
+	assert.Nil(t, err)
+
+	dl := domainLists{}.add("", f1).add("video", f2)
+	i, s, err := dl.loadFiles()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, i)
+	assert.Equal(t, 0, s)
+	assert.Equal(t, 3, dl.count())
+
+	l, ok := dl.match("api.facebook.com", "")
+	assert.True(t, ok)
+	assert.Equal(t, "", l)
+
+	l, ok = dl.match("www.youtube.com", "")
+	assert.True(t, ok)
+	assert.Equal(t, "video", l)
+
+	_, ok = dl.match("google.com", "")
+	assert.False(t, ok)
+
+	n, l, ok := dl.matchChain([]string{"www.vanity.org", "edge.youtube.com", "a.facebook.com"}, "")
+	assert.True(t, ok)
+	assert.Equal(t, "edge.youtube.com", n)
+	assert.Equal(t, "video", l)
+
+	_, _, ok = dl.matchChain([]string{"www.vanity.org"}, "")
+	assert.False(t, ok)
+
+	// The tagged list applies only to the replies with its tags
+	dl = domainLists{}.add("site", f2, "a", "b").add("", f1)
+	_, _, err = dl.loadFiles()
+	assert.Nil(t, err)
+
+	l, ok = dl.match("api.facebook.com", "b")
+	assert.True(t, ok)
+	assert.Equal(t, "site", l)
+
+	l, ok = dl.match("api.facebook.com", "")
+	assert.True(t, ok)
+	assert.Equal(t, "", l)
+
+	_, ok = dl.match("youtube.com", "c")
+	assert.False(t, ok)
+
+	os.Remove(f1)
+	os.Remove(f2)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+type gossipCfg struct {
+	// Where to listen for the gossip, both UDP and TCP are used
+	Listen string
+
+	// Address to announce to the other members if it differs from the listening one
+	Advertise string
+
+	// Unique name of the instance, the hostname by default
+	Name string
+
+	// Members to join on start, the join is retried while no other members are known
+	Seeds []string
+
+	// Key to encrypt and authenticate the gossip with, base64-encoded 16, 24 or 32 bytes
+	SecretKey string
+
+	// Syncer address of this instance for the other members,
+	// the advertised gossip IP with the syncer's listening port by default
+	SyncAddr string
+}
+
+// memberFunc is called when a member with the syncer address appears or disappears
+type memberFunc func(addr string, alive bool)
+
+// gossip discovers the other instances using the SWIM protocol
+type gossip struct {
+	ml    *memberlist.Memberlist
+	name  string
+	seeds []string
+	meta  []byte
+	cb    memberFunc
+
+	// Syncer addresses of the alive members by name
+	members map[string]string
+	sync.Mutex
+
+	shutdown chan struct{}
+}
+
+// logFilter drops the debug messages of the memberlist
+type logFilter struct{}
+
+func (logFilter) Write(b []byte) (int, error) {
+	if bytes.Contains(b, []byte("[DEBUG]")) {
+		return len(b), nil
+	}
+
+	return log.Writer().Write(b)
+}
+
+// newGossip starts the gossip, syncPort is the syncer's listening port to announce
+// or empty if it doesn't listen and the other members shouldn't sync with it
+func newGossip(cf *gossipCfg, syncPort string, cb memberFunc) (g *gossip, err error) {
+	if cf.Listen == "" {
+		return nil, fmt.Errorf("you need to specify gossip listening point")
+	}
+
+	g = &gossip{
+		seeds:    cf.Seeds,
+		cb:       cb,
+		members:  map[string]string{},
+		shutdown: make(chan struct{}),
+	}
+
+	c := memberlist.DefaultLANConfig()
+	c.Events = g
+	c.Delegate = g
+	c.Logger = log.New(logFilter{}, "Gossip: ", log.Flags())
+
+	if c.BindAddr, c.BindPort, err = splitHostPort(cf.Listen); err != nil {
+		return nil, fmt.Errorf("unable to parse gossip listen: %w", err)
+	}
+
+	if cf.Advertise != "" {
+		if c.AdvertiseAddr, c.AdvertisePort, err = splitHostPort(cf.Advertise); err != nil {
+			return nil, fmt.Errorf("unable to parse gossip advertise: %w", err)
+		}
+	}
+
+	if cf.Name != "" {
+		c.Name = cf.Name
+	} else if c.Name, err = os.Hostname(); err != nil {
+		return nil, fmt.Errorf("unable to get hostname: %w", err)
+	}
+
+	// The members become sync peers whose entries are announced, so only the ones knowing the key can join
+	if cf.SecretKey == "" {
+		return nil, fmt.Errorf("you need to specify gossip secretKey")
+	}
+
+	if c.SecretKey, err = base64.StdEncoding.DecodeString(cf.SecretKey); err != nil {
+		return nil, fmt.Errorf("unable to decode gossip secretKey: %w", err)
+	}
+
+	// The host is left empty to be filled with the member's address by the others
+	if cf.SyncAddr != "" {
+		g.meta = []byte(cf.SyncAddr)
+	} else if syncPort != "" {
+		g.meta = []byte(net.JoinHostPort("", syncPort))
+	}
+
+	g.name = c.Name
+	if len(g.meta) > memberlist.MetaMaxSize {
+		return nil, fmt.Errorf("gossip syncAddr is too long")
+	}
+
+	if g.ml, err = memberlist.Create(c); err != nil {
+		return nil, fmt.Errorf("unable to start gossip: %w", err)
+	}
+
+	if len(g.seeds) > 0 {
+		g.join()
+		go g.joinScheduler()
+	}
+
+	return
+}
+
+func splitHostPort(s string) (host string, port int, err error) {
+	h, p, err := net.SplitHostPort(s)
+	if err != nil {
+		return
+	}
+
+	port, err = strconv.Atoi(p)
+	return h, port, err
+}
+
+func (g *gossip) join() {
+	n, err := g.ml.Join(g.seeds)
+	if err != nil {
+		log.Printf("Gossip: unable to join some seeds (%d joined): %s", n, err)
+	}
+}
+
+// joinScheduler rejoins the seeds if the instance got isolated, e.g. started before all of them
+func (g *gossip) joinScheduler() {
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if g.ml.NumMembers() <= 1 {
+				g.join()
+			}
+
+		case <-g.shutdown:
+			return
+		}
+	}
+}
+
+// syncAddr returns the syncer address of the member
+func (g *gossip) syncAddr(n *memberlist.Node) string {
+	if len(n.Meta) == 0 {
+		return ""
+	}
+
+	host, port, err := net.SplitHostPort(string(n.Meta))
+	if err != nil {
+		log.Printf("Gossip: member %s has invalid syncer address '%s': %s", n.Name, n.Meta, err)
+		return ""
+	}
+
+	if host == "" {
+		host = n.Addr.String()
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// update applies the member's state and calls the callback if its syncer address has changed
+func (g *gossip) update(n *memberlist.Node, alive bool) {
+	addr := ""
+	if alive {
+		addr = g.syncAddr(n)
+	}
+
+	g.Lock()
+	old := g.members[n.Name]
+	if alive {
+		g.members[n.Name] = addr
+	} else {
+		delete(g.members, n.Name)
+	}
+	mGossipMembers.Set(float64(len(g.members)))
+	g.Unlock()
+
+	if old == addr {
+		return
+	}
+
+	if old != "" {
+		g.cb(old, false)
+	}
+
+	if addr != "" {
+		g.cb(addr, true)
+	}
+}
+
+func (g *gossip) NotifyJoin(n *memberlist.Node) {
+	if n.Name == g.name {
+		return
+	}
+
+	mGossipEvents.WithLabelValues("join").Inc()
+	log.Printf("Gossip: member %s (%s) joined, syncer: '%s'", n.Name, n.Address(), g.syncAddr(n))
+	g.update(n, true)
+}
+
+func (g *gossip) NotifyLeave(n *memberlist.Node) {
+	if n.Name == g.name {
+		return
+	}
+
+	mGossipEvents.WithLabelValues("leave").Inc()
+	log.Printf("Gossip: member %s (%s) left or failed", n.Name, n.Address())
+	g.update(n, false)
+}
+
+func (g *gossip) NotifyUpdate(n *memberlist.Node) {
+	if n.Name == g.name {
+		return
+	}
+
+	mGossipEvents.WithLabelValues("update").Inc()
+	log.Printf("Gossip: member %s (%s) updated, syncer: '%s'", n.Name, n.Address(), g.syncAddr(n))
+	g.update(n, true)
+}
+
+// NodeMeta announces the syncer address
+func (g *gossip) NodeMeta(limit int) []byte {
+	return g.meta
+}
+
+func (g *gossip) NotifyMsg([]byte)                           {}
+func (g *gossip) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (g *gossip) LocalState(join bool) []byte                { return nil }
+func (g *gossip) MergeRemoteState(buf []byte, join bool)     {}
+
+func (g *gossip) close() error {
+	close(g.shutdown)
+
+	if err := g.ml.Leave(5 * time.Second); err != nil {
+		log.Printf("Gossip: unable to leave gracefully: %s", err)
+	}
+
+	return g.ml.Shutdown()
+}
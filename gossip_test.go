@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_gossip(t *testing.T) {
+	var mtx sync.Mutex
+	peers := map[string]bool{}
+	cb := func(addr string, alive bool) {
+		mtx.Lock()
+		peers[addr] = alive
+		mtx.Unlock()
+	}
+
+	waitFor := func(addr string, alive bool) {
+		for i := 0; i < 100; i++ {
+			mtx.Lock()
+			a, ok := peers[addr]
+			mtx.Unlock()
+
+			if ok && a == alive {
+				return
+			}
+
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		t.Fatalf("peer %s hasn't become alive: %t", addr, alive)
+	}
+
+	_, err := newGossip(&gossipCfg{}, "", cb)
+	assert.NotNil(t, err)
+
+	_, err = newGossip(&gossipCfg{Listen: "127.0.0.1:0", SecretKey: "foo"}, "", cb)
+	assert.NotNil(t, err)
+
+	// The key is required
+	_, err = newGossip(&gossipCfg{Listen: "127.0.0.1:0"}, "", cb)
+	assert.NotNil(t, err)
+
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+
+	g1, err := newGossip(&gossipCfg{Listen: "127.0.0.1:0", Name: "g1", SecretKey: key}, "8080", cb)
+	assert.Nil(t, err)
+	defer g1.close()
+
+	seed := fmt.Sprintf("127.0.0.1:%d", g1.ml.LocalNode().Port)
+	g2, err := newGossip(&gossipCfg{Listen: "127.0.0.1:0", Name: "g2", SecretKey: key, Seeds: []string{seed}, SyncAddr: "foo:1234"}, "8081", cb)
+	assert.Nil(t, err)
+
+	// Both sides see each other with their syncer addresses
+	waitFor("foo:1234", true)
+	waitFor("127.0.0.1:8080", true)
+
+	// The members without the syncer listening are not reported
+	g3, err := newGossip(&gossipCfg{Listen: "127.0.0.1:0", Name: "g3", SecretKey: key, Seeds: []string{seed}}, "", cb)
+	assert.Nil(t, err)
+	defer g3.close()
+
+	for i := 0; i < 100 && g3.ml.NumMembers() < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, 3, g3.ml.NumMembers())
+
+	assert.Nil(t, g2.close())
+	waitFor("foo:1234", false)
+
+	mtx.Lock()
+	assert.Len(t, peers, 2)
+	mtx.Unlock()
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blind-oracle/dnstap-bgp/syncpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// The peers with this prefix are synced using gRPC
+	grpcPrefix = "grpc://"
+	// The size of the encoded entries after which a message is sent, well below the default 4MB gRPC limit
+	grpcBatchSize = 1 << 20
+)
+
+var (
+	mdTimestamp = strings.ToLower(headerTimestamp)
+	mdSignature = strings.ToLower(headerSignature)
+)
+
+func isGRPC(p string) bool {
+	return strings.HasPrefix(p, grpcPrefix)
+}
+
+func timeToPB(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+func timeFromPB(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ns)
+}
+
+func entryToPB(e *cacheEntry) *syncpb.Entry {
+	ip := e.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return &syncpb.Entry{
+		Ip:      ip,
+		Domain:  e.Domain,
+		List:    e.List,
+		Chain:   e.Chain,
+		Source:  e.Source,
+		Tag:     e.Tag,
+		Ts:      timeToPB(e.TS),
+		Expires: timeToPB(e.Expires),
+		Deleted: e.Deleted,
+		Origin:  e.Origin,
+		Hops:    e.Hops,
+	}
+}
+
+func entryFromPB(pe *syncpb.Entry) *cacheEntry {
+	e := &cacheEntry{
+		Domain:  pe.Domain,
+		List:    pe.List,
+		Chain:   pe.Chain,
+		Source:  pe.Source,
+		Tag:     pe.Tag,
+		TS:      timeFromPB(pe.Ts),
+		Expires: timeFromPB(pe.Expires),
+		Deleted: pe.Deleted,
+		Origin:  pe.Origin,
+		Hops:    pe.Hops,
+	}
+
+	// Invalid addresses are left nil to be rejected by the inbound policy
+	if len(pe.Ip) == net.IPv4len || len(pe.Ip) == net.IPv6len {
+		e.IP = net.IP(pe.Ip)
+	}
+
+	return e
+}
+
+// batchPB passes the entries to fn in the batches of at most changesBatch entries and about grpcBatchSize bytes
+// along with the number of the entries passed so far. An empty list is passed as an empty batch.
+func batchPB(es []*cacheEntry, fn func(pes []*syncpb.Entry, n int) error) error {
+	var pes []*syncpb.Entry
+	size := 0
+
+	for i, e := range es {
+		pe := entryToPB(e)
+		pes, size = append(pes, pe), size+proto.Size(pe)
+
+		if len(pes) < changesBatch && size < grpcBatchSize {
+			continue
+		}
+
+		if err := fn(pes, i+1); err != nil {
+			return err
+		}
+
+		pes, size = nil, 0
+	}
+
+	if len(pes) == 0 && len(es) > 0 {
+		return nil
+	}
+
+	return fn(pes, len(es))
+}
+
+// sendChanges sends the changes following the from sequence number, each batch with the sequence of its last entry
+func sendChanges(stream pullStream, epoch string, from uint64, es []*cacheEntry) error {
+	return batchPB(es, func(pes []*syncpb.Entry, n int) error {
+		return stream.Send(&syncpb.PullResponse{Epoch: epoch, Seq: from + uint64(n), Entries: pes})
+	})
+}
+
+// grpcSyncer serves the gRPC sync
+type grpcSyncer struct {
+	syncpb.UnimplementedSyncerServer
+	s *syncer
+}
+
+// pullStream is the server side of the Pull and Watch streams
+type pullStream interface {
+	Send(*syncpb.PullResponse) error
+	Context() context.Context
+}
+
+// initGRPC prepares the gRPC client and starts the server if the address is set
+func (s *syncer) initGRPC(listen string, stc, ctc *tls.Config) (err error) {
+	creds := insecure.NewCredentials()
+	if ctc != nil {
+		creds = credentials.NewTLS(ctc)
+	}
+
+	s.dialOpts = []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithStreamInterceptor(s.signStream),
+	}
+
+	if listen == "" {
+		return
+	}
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen for gRPC: %w", err)
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.StreamInterceptor(s.authStream),
+	}
+
+	if stc != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(stc)))
+	}
+
+	s.gs = grpc.NewServer(opts...)
+	syncpb.RegisterSyncerServer(s.gs, &grpcSyncer{s: s})
+
+	go func() {
+		if err := s.gs.Serve(l); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	return
+}
+
+// signStream signs the call like an HTTP request to the method's path.
+// The stream itself isn't covered, so TLS is required along with the secret.
+func (s *syncer) signStream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if len(s.secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		ctx = metadata.AppendToOutgoingContext(ctx, mdTimestamp, ts, mdSignature, s.sign("POST", method, ts, nil))
+	}
+
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// authStream rejects the calls not signed with the shared secret
+func (s *syncer) authStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if len(s.secret) == 0 {
+		return handler(srv, ss)
+	}
+
+	get := func(md metadata.MD, k string) string {
+		if v := md.Get(k); len(v) > 0 {
+			return v[0]
+		}
+
+		return ""
+	}
+
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	if err := s.checkSignature("POST", info.FullMethod, get(md, mdTimestamp), get(md, mdSignature), nil); err != nil {
+		log.Printf("Syncer: rejected unauthenticated call to %s from %s: %s", info.FullMethod, peerHost(ss.Context()), err)
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	return handler(srv, ss)
+}
+
+func peerHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
+
+func (g *grpcSyncer) Push(stream syncpb.Syncer_PushServer) error {
+	host := peerHost(stream.Context())
+
+	var new, rejected int
+	defer func() {
+		g.s.pushed(host, new, rejected)
+	}()
+
+	for {
+		b, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&syncpb.PushResponse{Applied: uint64(new)})
+		} else if err != nil {
+			return err
+		}
+
+		for _, pe := range b.Entries {
+			applied, rej := g.s.receive(host, entryFromPB(pe))
+			if applied {
+				new++
+			} else if rej {
+				rejected++
+			}
+		}
+	}
+}
+
+func (g *grpcSyncer) Pull(req *syncpb.PullRequest, stream syncpb.Syncer_PullServer) error {
+	_, err := g.pull(req, stream)
+	return err
+}
+
+func (g *grpcSyncer) Watch(req *syncpb.PullRequest, stream syncpb.Syncer_WatchServer) error {
+	st, err := g.pull(req, stream)
+	if err != nil {
+		return err
+	}
+
+	for {
+		// Taken before looking for the changes so that none is missed in between
+		ch := g.s.changes.wait()
+
+		es, last, ok := g.s.changes.since(st.Epoch, st.Seq, changesBatch)
+		if !ok {
+			// Fell behind, the peer will pull the whole cache on reconnect
+			return status.Error(codes.DataLoss, "changes are no longer available")
+		}
+
+		if len(es) > 0 {
+			if err = sendChanges(stream, st.Epoch, st.Seq, es); err != nil {
+				return err
+			}
+
+			st.Seq = last
+			continue
+		}
+
+		select {
+		case <-ch:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-g.s.shutdown:
+			return nil
+		}
+	}
+}
+
+// pull sends the changes since the requested state or the whole cache if they're not available.
+// The whole cache is sent in the batches marked as full followed by a batch with the resulting state.
+func (g *grpcSyncer) pull(req *syncpb.PullRequest, stream pullStream) (*syncState, error) {
+	epoch := g.s.changes.state().Epoch
+
+	if es, last, ok := g.s.changes.since(req.Epoch, req.Seq, changesBatch); ok {
+		from := req.Seq
+		for {
+			if err := sendChanges(stream, epoch, from, es); err != nil {
+				return nil, err
+			}
+
+			if len(es) < changesBatch {
+				return &syncState{Epoch: epoch, Seq: last}, nil
+			}
+
+			from = last
+			if es, last, ok = g.s.changes.since(epoch, last, changesBatch); !ok {
+				break
+			}
+		}
+	}
+
+	// The entries added while the snapshot is taken will be also sent in the next delta
+	st := g.s.changes.state()
+
+	var err error
+	var batch []*syncpb.Entry
+	size := 0
+	flush := func() bool {
+		err = stream.Send(&syncpb.PullResponse{Epoch: st.Epoch, Seq: st.Seq, Full: true, Entries: batch})
+		// The message can't be changed after it's sent
+		batch, size = nil, 0
+		return err == nil
+	}
+
+	g.s.each(func(e *cacheEntry) bool {
+		pe := entryToPB(e)
+		if batch, size = append(batch, pe), size+proto.Size(pe); len(batch) < changesBatch && size < grpcBatchSize {
+			return true
+		}
+
+		return flush()
+	})
+
+	if err == nil && len(batch) > 0 {
+		flush()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := stream.Send(&syncpb.PullResponse{Epoch: st.Epoch, Seq: st.Seq}); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// client returns the gRPC client of the peer, the connection is established in the background
+func (s *syncer) client(p string) (syncpb.SyncerClient, error) {
+	s.connsMtx.Lock()
+	defer s.connsMtx.Unlock()
+
+	c, ok := s.conns[p]
+	if !ok {
+		var err error
+		if c, err = grpc.Dial(strings.TrimPrefix(p, grpcPrefix), s.dialOpts...); err != nil {
+			return nil, err
+		}
+
+		s.conns[p] = c
+	}
+
+	return syncpb.NewSyncerClient(c), nil
+}
+
+// pushGRPC streams the entries to the peer, they're either all sent or none
+func (s *syncer) pushGRPC(es []*cacheEntry, p string) (n int, err error) {
+	defer func() {
+		mSyncerRequests.WithLabelValues(p, "push", resultLabel(err)).Inc()
+	}()
+
+	c, err := s.client(p)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	stream, err := c.Push(ctx)
+	if err != nil {
+		return
+	}
+
+	if err = batchPB(es, func(pes []*syncpb.Entry, _ int) error {
+		return stream.Send(&syncpb.Batch{Entries: pes})
+	}); err != nil {
+		return
+	}
+
+	if _, err = stream.CloseAndRecv(); err != nil {
+		return
+	}
+
+	return len(es), nil
+}
+
+// recvPull passes the pulled entries to fn and saves the state once the peer reaches it.
+// The state is not saved if the full sync is interrupted.
+func (s *syncer) recvPull(p string, recv func() (*syncpb.PullResponse, error), fn func(*cacheEntry)) (full bool, err error) {
+	for {
+		resp, err := recv()
+		if err == io.EOF {
+			return full, nil
+		} else if err != nil {
+			return full, err
+		}
+
+		for _, pe := range resp.Entries {
+			fn(entryFromPB(pe))
+		}
+
+		if resp.Full {
+			full = true
+			continue
+		}
+
+		s.saveState(p, &syncState{Epoch: resp.Epoch, Seq: resp.Seq})
+	}
+}
+
+func (s *syncer) pullRequest(p string) *syncpb.PullRequest {
+	req := &syncpb.PullRequest{}
+	if st := s.state(p); st != nil {
+		req.Epoch, req.Seq = st.Epoch, st.Seq
+	}
+
+	return req
+}
+
+// pullGRPC fetches the changes since the last sync or the whole cache from the peer
+func (s *syncer) pullGRPC(p string, fn func(*cacheEntry)) (full bool, err error) {
+	defer func() {
+		mSyncerRequests.WithLabelValues(p, "pull", resultLabel(err)).Inc()
+	}()
+
+	c, err := s.client(p)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := c.Pull(ctx, s.pullRequest(p))
+	if err != nil {
+		return
+	}
+
+	return s.recvPull(p, stream.Recv, fn)
+}
+
+// watchPeer follows the changes of the peer until the shutdown, reconnecting on errors
+func (s *syncer) watchPeer(p string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-s.shutdown
+		cancel()
+	}()
+
+	add := func(e *cacheEntry) {
+		e.Source = "peer " + p
+		if s.accept(p, e) == "" && s.add(e, false) {
+			s.relayEntry(e)
+		}
+	}
+
+	delay := s.retryMin
+	for {
+		t := time.Now()
+		err := s.watchStream(ctx, p, add)
+
+		select {
+		case <-s.shutdown:
+			return
+		default:
+		}
+
+		// The stream has been up for a while, so the peer is fine
+		if time.Since(t) > s.retryMax {
+			delay = s.retryMin
+		}
+
+		log.Printf("Syncer: watching peer %s failed, retrying in %s: %v", p, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-s.shutdown:
+			return
+		}
+
+		if delay *= 2; delay > s.retryMax {
+			delay = s.retryMax
+		}
+	}
+}
+
+func (s *syncer) watchStream(ctx context.Context, p string, fn func(*cacheEntry)) (err error) {
+	defer func() {
+		mSyncerRequests.WithLabelValues(p, "watch", resultLabel(err)).Inc()
+	}()
+
+	c, err := s.client(p)
+	if err != nil {
+		return
+	}
+
+	stream, err := c.Watch(ctx, s.pullRequest(p))
+	if err != nil {
+		return
+	}
+
+	if _, err = s.recvPull(p, stream.Recv, fn); err == nil {
+		err = io.EOF
+	}
+
+	return
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blind-oracle/dnstap-bgp/syncpb"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_entryPB(t *testing.T) {
+	for _, e := range []*cacheEntry{
+		{IP: net.ParseIP("1.2.3.4"), Domain: "foo.bar", List: "foo", Chain: []string{"a.foo", "foo.bar"}, TS: time.Now(), Expires: time.Now().Add(time.Hour)},
+		{IP: net.ParseIP("2001:db8::1"), Domain: "foo.bar", TS: time.Now(), Tag: "site", Deleted: true, Origin: "a", Hops: []string{"a", "b"}},
+	} {
+		e2 := entryFromPB(entryToPB(e))
+		assert.True(t, e.IP.Equal(e2.IP))
+		assert.True(t, e.TS.Equal(e2.TS))
+		assert.True(t, e.Expires.Equal(e2.Expires))
+		e2.IP, e2.TS, e2.Expires = e.IP, e.TS, e.Expires
+		assert.Equal(t, e, e2)
+	}
+
+	e := entryFromPB(entryToPB(&cacheEntry{Domain: "foo.bar"}))
+	assert.Nil(t, e.IP)
+	assert.True(t, e.TS.IsZero())
+}
+
+func Test_batchPB(t *testing.T) {
+	// Each entry takes more than a half of the batch
+	chain := []string{strings.Repeat("a", grpcBatchSize/2)}
+	es := []*cacheEntry{{Domain: "a", Chain: chain}, {Domain: "b", Chain: chain}, {Domain: "c", Chain: chain}}
+
+	var sizes, ns []int
+	batch := func(pes []*syncpb.Entry, n int) error {
+		sizes, ns = append(sizes, len(pes)), append(ns, n)
+		return nil
+	}
+
+	assert.Nil(t, batchPB(es, batch))
+	assert.Equal(t, []int{2, 1}, sizes)
+	assert.Equal(t, []int{2, 3}, ns)
+
+	sizes, ns = nil, nil
+	assert.Nil(t, batchPB(es[:2], batch))
+	assert.Equal(t, []int{2}, sizes)
+
+	// The empty list is sent too, to pass the state
+	sizes, ns = nil, nil
+	assert.Nil(t, batchPB(nil, batch))
+	assert.Equal(t, []int{0}, sizes)
+	assert.Equal(t, []int{0}, ns)
+}
+
+func Test_syncerGRPC(t *testing.T) {
+	es := []*cacheEntry{
+		{IP: net.ParseIP("1.2.3.4"), Domain: "foo.bar", TS: time.Now()},
+		{IP: net.ParseIP("4.3.2.1"), Domain: "bar.foo", TS: time.Now()},
+	}
+
+	ga := eachOf(es)
+
+	var mtx sync.Mutex
+	added := map[string][]*cacheEntry{}
+	adder := func(name string) addFunc {
+		return func(e *cacheEntry, b bool) bool {
+			mtx.Lock()
+			defer mtx.Unlock()
+			added[name] = append(added[name], e)
+			return true
+		}
+	}
+
+	got := func(name string) []*cacheEntry {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return added[name]
+	}
+
+	var syncErr error
+	cb := func(p string, n, r int, err error) {
+		syncErr = err
+	}
+
+	port := rand.Intn(60000) + 2000
+	p := fmt.Sprintf("grpc://127.0.0.1:%d", port)
+
+	// The secret doesn't cover the streams, so TLS is required with it
+	_, err := newSyncer(&syncerCfg{SyncInterval: "0s", Secret: "foo", Peers: []string{p}}, ga, adder("cl"), cb, nil, nil)
+	assert.NotNil(t, err)
+
+	dir := genTLS(t)
+	tc := &tlsCfg{
+		Cert: filepath.Join(dir, "server.crt"),
+		Key:  filepath.Join(dir, "server.key"),
+		CA:   filepath.Join(dir, "ca.crt"),
+	}
+
+	srv, err := newSyncer(&syncerCfg{
+		SyncInterval: "0s",
+		Secret:       "foo",
+		TLS:          tc,
+		GRPCListen:   fmt.Sprintf("127.0.0.1:%d", port),
+	}, ga, adder("srv"), cb, nil, nil)
+	assert.Nil(t, err)
+	defer srv.close()
+
+	cl, err := newSyncer(&syncerCfg{
+		SyncInterval: "0s",
+		Secret:       "foo",
+		TLS:          tc,
+		Peers:        []string{p},
+	}, ga, adder("cl"), cb, nil, nil)
+	assert.Nil(t, err)
+	defer cl.close()
+
+	// Full pull first, then only the changes
+	cl.syncAll()
+	assert.Nil(t, syncErr)
+	assert.Len(t, got("cl"), 2)
+	assert.Equal(t, "peer "+p, got("cl")[1].Source)
+	assert.Equal(t, srv.changes.state(), cl.states[p])
+
+	srv.record(&cacheEntry{IP: net.ParseIP("1.1.1.1"), Domain: "foo.foo", TS: time.Now()})
+	cl.syncAll()
+	assert.Len(t, got("cl"), 3)
+	assert.Equal(t, "foo.foo", got("cl")[2].Domain)
+	assert.Equal(t, srv.changes.state(), cl.states[p])
+
+	// Push
+	n, err := cl.sendBatch(es, p)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Len(t, got("srv"), 2)
+	assert.Equal(t, "peer 127.0.0.1", got("srv")[0].Source)
+
+	// Watch
+	w, err := newSyncer(&syncerCfg{
+		SyncInterval: "0s",
+		Secret:       "foo",
+		TLS:          tc,
+		Peers:        []string{p},
+		Watch:        true,
+	}, ga, adder("w"), cb, nil, nil)
+	assert.Nil(t, err)
+	defer w.close()
+
+	wait := func(n int) {
+		for i := 0; i < 100 && len(got("w")) < n; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		assert.Len(t, got("w"), n)
+	}
+
+	wait(2)
+	srv.record(&cacheEntry{IP: net.ParseIP("2.2.2.2"), Domain: "bar.bar", TS: time.Now()})
+	wait(3)
+	assert.Equal(t, "bar.bar", got("w")[2].Domain)
+
+	// Wrong secret
+	bad, err := newSyncer(&syncerCfg{
+		SyncInterval: "0s",
+		Secret:       "bar",
+		TLS:          tc,
+		Peers:        []string{p},
+	}, ga, adder("bad"), cb, nil, nil)
+	assert.Nil(t, err)
+	defer bad.close()
+
+	bad.syncAll()
+	assert.NotNil(t, syncErr)
+	assert.Len(t, got("bad"), 0)
+
+	_, err = bad.sendBatch(es, p)
+	assert.NotNil(t, err)
+	assert.Len(t, got("srv"), 2)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+type inboundCfg struct {
+	// Accept only the entries with the domains matching the local lists.
+	// The list to announce with is also taken from the local match then.
+	MatchLists bool
+
+	// Accept only the IPs from these prefixes
+	Allow []string
+
+	// Reject the IPs from these prefixes, checked before the allowed ones
+	Deny []string
+
+	// How far in the future the entries' timestamps can be
+	MaxFuture string
+}
+
+// inboundPolicy validates the entries received from the peers
+type inboundPolicy struct {
+	lists      domainLists
+	matchLists bool
+	allow      []*net.IPNet
+	deny       []*net.IPNet
+	maxFuture  time.Duration
+}
+
+func parsePrefixes(ss []string) (ps []*net.IPNet, err error) {
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+
+		ps = append(ps, n)
+	}
+
+	return
+}
+
+func containsIP(ps []*net.IPNet, ip net.IP) bool {
+	for _, p := range ps {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newInboundPolicy(cf *inboundCfg, lists domainLists) (p *inboundPolicy, err error) {
+	p = &inboundPolicy{
+		lists: lists,
+	}
+
+	if cf == nil {
+		return
+	}
+
+	p.matchLists = cf.MatchLists
+
+	if p.allow, err = parsePrefixes(cf.Allow); err != nil {
+		return nil, fmt.Errorf("unable to parse allowed prefixes: %w", err)
+	}
+
+	if p.deny, err = parsePrefixes(cf.Deny); err != nil {
+		return nil, fmt.Errorf("unable to parse denied prefixes: %w", err)
+	}
+
+	if cf.MaxFuture != "" {
+		if p.maxFuture, err = time.ParseDuration(cf.MaxFuture); err != nil {
+			return nil, fmt.Errorf("unable to parse maxFuture: %w", err)
+		}
+
+		if p.maxFuture <= 0 {
+			return nil, fmt.Errorf("maxFuture should be positive")
+		}
+	}
+
+	return
+}
+
+// check returns the reason to reject the entry or an empty string if it's accepted.
+// If the lists are matched the entry's domain and list are set to the local match.
+func (p *inboundPolicy) check(e *cacheEntry) string {
+	if e.IP == nil || containsIP(p.deny, e.IP) || (len(p.allow) > 0 && !containsIP(p.allow, e.IP)) {
+		return "ip"
+	}
+
+	if p.maxFuture > 0 && e.TS.After(time.Now().Add(p.maxFuture)) {
+		return "timestamp"
+	}
+
+	if !p.matchLists {
+		return ""
+	}
+
+	chain := e.Chain
+	if len(chain) == 0 {
+		chain = []string{e.Domain}
+	}
+
+	domain, list, ok := p.lists.matchChain(chain, e.Tag)
+	if !ok {
+		return "domain"
+	}
+
+	e.Domain, e.List = domain, list
+	return ""
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_inboundPolicy(t *testing.T) {
+	dt := newDomainTree()
+	dt.loadList([]string{"com.youtube"})
+	dl := domainLists{{name: "video", t: dt}}
+
+	_, err := newInboundPolicy(&inboundCfg{Allow: []string{"foo"}}, dl)
+	assert.NotNil(t, err)
+
+	_, err = newInboundPolicy(&inboundCfg{MaxFuture: "-1m"}, dl)
+	assert.NotNil(t, err)
+
+	// No policy accepts everything
+	p, err := newInboundPolicy(nil, dl)
+	assert.Nil(t, err)
+	assert.Equal(t, "", p.check(&cacheEntry{IP: net.ParseIP("1.2.3.4"), Domain: "foo.bar", TS: time.Now().Add(time.Hour)}))
+
+	p, err = newInboundPolicy(&inboundCfg{
+		MatchLists: true,
+		Allow:      []string{"1.2.3.0/24", "2001:db8::/32"},
+		Deny:       []string{"1.2.3.4"},
+		MaxFuture:  "1m",
+	}, dl)
+	assert.Nil(t, err)
+
+	e := func(ip, domain string, chain ...string) *cacheEntry {
+		return &cacheEntry{IP: net.ParseIP(ip), Domain: domain, List: "foo", Chain: chain, TS: time.Now()}
+	}
+
+	assert.Equal(t, "ip", p.check(e("1.2.3.4", "youtube.com")))
+	assert.Equal(t, "ip", p.check(e("1.2.4.1", "youtube.com")))
+	assert.Equal(t, "ip", p.check(&cacheEntry{Domain: "youtube.com"}))
+	assert.Equal(t, "domain", p.check(e("1.2.3.5", "foo.bar")))
+
+	e1 := e("1.2.3.5", "youtube.com")
+	e1.TS = e1.TS.Add(time.Hour)
+	assert.Equal(t, "timestamp", p.check(e1))
+
+	// The list is taken from the local match
+	e1 = e("2001:db8::1", "youtube.com")
+	assert.Equal(t, "", p.check(e1))
+	assert.Equal(t, "video", e1.List)
+
+	e1 = e("1.2.3.5", "www.youtube.com", "foo.bar", "www.youtube.com")
+	assert.Equal(t, "", p.check(e1))
+	assert.Equal(t, "www.youtube.com", e1.Domain)
+}
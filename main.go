@@ -2,8 +2,8 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
-	"net"
 	"os"
 	"os/signal"
 	"syscall"
@@ -12,26 +12,116 @@ import (
 	"github.com/BurntSushi/toml"
 )
 
+type listCfg struct {
+	Name    string
+	Domains string
+	// Apply the list only to the replies from the DNSTap listeners with these tags
+	Tags []string
+	bgpPolicy
+}
+
 type cfgRoot struct {
 	Domains string
 	Cache   string
 	TTL     string
 	IPv6    bool
 
-	DNSTap *dnstapCfg
-	BGP    *bgpCfg
-	Syncer *syncerCfg
+	// "fixed" (default) or "dns"
+	TTLMode       string
+	TTLMultiplier float64
+	TTLMin        string
+	TTLMax        string
+
+	// Withdraw the IPs of the domains removed from the lists on reload
+	// instead of letting them expire
+	WithdrawOnReload bool
+
+	List      []*listCfg
+	Metrics   *metricsCfg
+	Admin     *adminCfg
+	Bootstrap *bootstrapCfg
+	BGP       *bgpCfg
+	Syncer    *syncerCfg
+	Proxy     *proxyCfg
+	PowerDNS  []*pdnsCfg
+
+	// A single [dnstap] table or several [[dnstap]] ones
+	DNSTap toml.Primitive
 }
 
 var (
 	version string
 )
 
+func (c *cfgRoot) ttlPolicy(ttl time.Duration) (p *ttlPolicy, err error) {
+	p = &ttlPolicy{
+		fixed:      ttl,
+		multiplier: 1,
+		max:        ttl,
+	}
+
+	switch c.TTLMode {
+	case "", "fixed":
+		return
+	case "dns":
+		p.dns = true
+	default:
+		return nil, fmt.Errorf("unknown TTL mode '%s'", c.TTLMode)
+	}
+
+	if c.TTLMultiplier < 0 {
+		return nil, fmt.Errorf("TTL multiplier should be positive")
+	} else if c.TTLMultiplier > 0 {
+		p.multiplier = c.TTLMultiplier
+	}
+
+	if c.TTLMax != "" {
+		if p.max, err = time.ParseDuration(c.TTLMax); err != nil {
+			return nil, fmt.Errorf("unable to parse TTL max: %w", err)
+		}
+	}
+
+	// The entries living shorter than the cleanup interval would be withdrawn
+	// and announced again on every query
+	p.min = cleanupInterval
+	if c.TTLMin != "" {
+		if p.min, err = time.ParseDuration(c.TTLMin); err != nil {
+			return nil, fmt.Errorf("unable to parse TTL min: %w", err)
+		}
+	} else if p.max > 0 && p.max < p.min {
+		p.min = p.max
+	}
+
+	if p.max > 0 && p.min > p.max {
+		return nil, fmt.Errorf("TTL min should not be greater than TTL max")
+	}
+
+	return
+}
+
+// dnstapCfgs decodes the DNSTap listeners
+func (c *cfgRoot) dnstapCfgs(md toml.MetaData) (cfs []*dnstapCfg, err error) {
+	if err = md.PrimitiveDecode(c.DNSTap, &cfs); err == nil {
+		return
+	}
+
+	cf := &dnstapCfg{}
+	if err = md.PrimitiveDecode(c.DNSTap, cf); err != nil {
+		return nil, err
+	}
+
+	return []*dnstapCfg{cf}, nil
+}
+
 func main() {
 	var (
-		bgp    *bgpServer
-		ipDB   *db
-		syncer *syncer
+		bgp     *bgpServer
+		ipDB    *db
+		ipCache *cache
+		syncer  *syncer
+
+		// How often the refreshes of the entries are propagated to the peers and the DB
+		refreshInterval time.Duration
 
 		err      error
 		shutdown = make(chan struct{})
@@ -47,17 +137,57 @@ func main() {
 	}
 
 	cfg := &cfgRoot{}
-	if _, err = toml.DecodeFile(*config, &cfg); err != nil {
+	md, err := toml.DecodeFile(*config, &cfg)
+	if err != nil {
 		log.Fatalf("Unable to parse config file '%s': %s", *config, err)
 	}
 
-	cfg.DNSTap.IPv6 = cfg.IPv6
+	dnstapCfgs, err := cfg.dnstapCfgs(md)
+	if err != nil {
+		log.Fatalf("Unable to parse DNSTap config: %s", err)
+	}
+
+	if len(dnstapCfgs) == 0 && cfg.Proxy == nil && len(cfg.PowerDNS) == 0 {
+		log.Fatal("You need to configure at least one DNSTap or PowerDNS listener or the DNS proxy")
+	}
+
+	for _, c := range dnstapCfgs {
+		c.IPv6 = cfg.IPv6
+	}
+
+	if cfg.Proxy != nil {
+		cfg.Proxy.IPv6 = cfg.IPv6
+	}
+
+	for _, c := range cfg.PowerDNS {
+		c.IPv6 = cfg.IPv6
+	}
+
 	cfg.BGP.IPv6 = cfg.IPv6
 
-	if cfg.Domains == "" {
+	if cfg.Domains == "" && len(cfg.List) == 0 {
 		log.Fatal("You need to specify path to a domain list")
 	}
 
+	dLists := domainLists{}
+	if cfg.Domains != "" {
+		dLists = dLists.add("", cfg.Domains)
+	}
+
+	cfg.BGP.Policies = map[string]*bgpPolicy{}
+	for _, l := range cfg.List {
+		if l.Name == "" || l.Domains == "" {
+			log.Fatal("You need to specify a name and a path to a domain list for each list")
+		}
+
+		if _, ok := cfg.BGP.Policies[l.Name]; ok {
+			log.Fatalf("Domain list '%s' is defined more than once", l.Name)
+		}
+
+		cfg.BGP.Policies[l.Name] = &l.bgpPolicy
+		dLists = dLists.add(l.Name, l.Domains, l.Tags...)
+	}
+
 	ttl := 24 * time.Hour
 	if cfg.TTL != "" {
 		if ttl, err = time.ParseDuration(cfg.TTL); err != nil {
@@ -65,19 +195,75 @@ func main() {
 		}
 	}
 
-	expireCb := func(e *cacheEntry) {
-		log.Printf("%s (%s) expired", e.IP, e.Domain)
-		bgp.delHost(e.IP)
+	ttlPol, err := cfg.ttlPolicy(ttl)
+	if err != nil {
+		log.Fatalf("Unable to init TTL policy: %s", err)
+	}
+
+	// dropRef handles a removed domain reference of an IP: the IP is withdrawn if it was the last one
+	// or re-announced if it's now announced with the policy of another list
+	dropRef := func(e, next *cacheEntry) (withdrawn bool) {
+		if ipDB != nil {
+			ipDB.del(e)
+		}
+
+		if next == nil {
+			if err := bgp.delHost(e.IP, e.List); err != nil {
+				log.Printf("Unable to withdraw %s: %s", e.IP, err)
+			}
+
+			return true
+		}
+
+		if next.List != e.List {
+			if err := bgp.moveHost(e.IP, e.List, next.List); err != nil {
+				log.Printf("Unable to re-announce %s: %s", e.IP, err)
+			}
+		}
+
+		return false
+	}
+
+	// tombstone propagates the removal of the reference to the peers, their versions
+	// of it not newer than ts are removed too
+	tombstone := func(e *cacheEntry, ts time.Time) {
+		t := *e
+		t.TS, t.Deleted = ts, true
+		ipCache.tombstone(&t)
+
+		if syncer != nil {
+			syncer.record(&t)
+			syncer.broadcast(&t)
+		}
+	}
+
+	expireCb := func(e, next *cacheEntry) {
+		mCacheExpired.Inc()
+		log.Printf("%s (%s) expired, withdrawn: %t", e.IP, e.Domain, dropRef(e, next))
+		tombstone(e, e.TS)
+	}
 
+	// addCb stores the added reference and announces the IP if it's new, it's called under the cache lock
+	// so that a concurrent removal of the reference can't withdraw the IP or delete it from the DB in between
+	addCb := func(e *cacheEntry, announce bool) {
 		if ipDB != nil {
-			ipDB.del(e.IP)
+			if err := ipDB.add(e); err != nil {
+				log.Printf("Unable to add (%s, %s) to DB: %s", e.IP, e.Domain, err)
+			}
+		}
+
+		if !announce {
+			return
+		}
+
+		if err := bgp.addHost(e.IP, e.List); err != nil {
+			log.Printf("Unable to announce %s: %s", e.IP, err)
 		}
 	}
 
-	ipCache := newCache(ttl, expireCb)
-	dTree := newDomainTree()
+	ipCache = newCache(ttl, addCb, expireCb)
 
-	cnt, skip, err := dTree.loadFile(cfg.Domains)
+	cnt, skip, err := dLists.loadFiles()
 	if err != nil {
 		log.Fatalf("Unable to load domain list: %s", err)
 	}
@@ -89,11 +275,12 @@ func main() {
 	}
 
 	if cfg.Cache != "" {
-		if ipDB, err = newDB(cfg.Cache); err != nil {
+		db, err := newDB(cfg.Cache)
+		if err != nil {
 			log.Fatalf("Unable to init DB '%s': %s", cfg.Cache, err)
 		}
 
-		es, err := ipDB.fetchAll()
+		es, err := db.fetchAll()
 		if err != nil {
 			log.Fatalf("Unable to load entries from DB: %s", err)
 		}
@@ -101,24 +288,32 @@ func main() {
 		now := time.Now()
 		i, j, k := 0, 0, 0
 		for _, e := range es {
-			if now.Sub(e.TS) >= ttl {
-				ipDB.del(e.IP)
+			if e.Expires.IsZero() {
+				e.Expires = e.TS.Add(ttl)
+			}
+
+			if !now.Before(e.Expires) {
+				db.del(e)
 				j++
 				continue
 			}
 
-			if !dTree.has(e.Domain) {
-				ipDB.del(e.IP)
+			list, ok := dLists.match(e.Domain, e.Tag)
+			if !ok {
+				db.del(e)
 				k++
 				continue
 			}
 
+			e.List = list
 			ipCache.add(e)
-			bgp.addHost(e.IP)
 			i++
 		}
 
 		log.Printf("Loaded from DB: %d, expired: %d, vanished: %d", i, j, k)
+
+		// The loaded entries are already stored, the DB is used by addCb from now on
+		ipDB = db
 	}
 
 	ipDBPut := func(e *cacheEntry) {
@@ -131,64 +326,165 @@ func main() {
 		}
 	}
 
-	addEntry := func(e *cacheEntry, touch bool) bool {
-		if ipCache.exists(e.IP, touch) {
-			if touch {
-				ipDBPut(e)
+	record := func(e *cacheEntry) {
+		if syncer != nil {
+			syncer.record(e)
+		}
+	}
+
+	// addEntry adds a local entry or refreshes the cached one, the peers' entries are merged
+	// with the cached ones by the timestamp. Returns true if the cache was changed.
+	addEntry := func(e *cacheEntry, local bool) bool {
+		if local {
+			if ce, bumped := ipCache.refresh(e, refreshInterval); ce != nil {
+				if bumped {
+					ipDBPut(ce)
+					record(ce)
+				}
+
+				return bumped
 			}
+		} else {
+			// The removed reference is dropped under the cache lock so that it's not re-added in between
+			res, ce := ipCache.merge(e, func(ce, next *cacheEntry) {
+				log.Printf("%s (%s) removed by %s, withdrawn: %t", e.IP, e.Domain, e.Source, dropRef(ce, next))
+			})
+
+			switch res {
+			case mergeStale:
+				return false
+
+			case mergeRefreshed:
+				ipDBPut(ce)
+				record(ce)
+				return true
+
+			case mergeDeleted:
+				record(e)
+				return true
+			}
+		}
 
+		log.Printf("%s: %s (list: %q, chain: %v, from peer: %t)", e.Domain, e.IP, e.List, e.Chain, !local)
+		ipCache.add(e)
+		record(e)
+
+		return true
+	}
+
+	// publish adds the entry and pushes it to the peers if it has changed the cache
+	publish := func(e *cacheEntry, local bool) bool {
+		if !addEntry(e, local) {
 			return false
 		}
 
-		log.Printf("%s: %s (from peer: %t)", e.Domain, e.IP, !touch)
-		bgp.addHost(e.IP)
-		ipCache.add(e)
-		ipDBPut(e)
+		if syncer != nil {
+			syncer.broadcast(e)
+		}
 
 		return true
 	}
 
 	if cfg.Syncer != nil {
-		if cfg.Syncer.Listen != "" || len(cfg.Syncer.Peers) > 0 {
-			syncerCb := func(peer string, new int, err error) {
-				log.Printf("Syncer: Peer %s: synced: %d error: %v", peer, new, err)
+		if cfg.Syncer.Listen != "" || cfg.Syncer.GRPCListen != "" || len(cfg.Syncer.Peers) > 0 || cfg.Syncer.Gossip != nil {
+			syncerCb := func(peer string, new, rejected int, err error) {
+				log.Printf("Syncer: Peer %s: synced: %d rejected: %d error: %v", peer, new, rejected, err)
 			}
 
-			if syncer, err = newSyncer(cfg.Syncer, ipCache.getAll, addEntry, syncerCb); err != nil {
+			var store syncStateStore
+			if ipDB != nil {
+				store = ipDB
+			}
+
+			if syncer, err = newSyncer(cfg.Syncer, ipCache.each, addEntry, syncerCb, store, dLists); err != nil {
 				log.Fatalf("Unable to init syncer: %s", err)
 			}
+
+			refreshInterval = syncer.refreshInterval
 		}
 	}
 
-	addHostCb := func(ip net.IP, domain string) {
-		if !dTree.has(domain) {
-			return
+	addHostCb := func(d *dnsEntry) bool {
+		domain, list, ok := dLists.matchChain(d.chain, d.tag)
+		if !ok {
+			return false
 		}
 
+		now := time.Now()
 		e := &cacheEntry{
-			IP:     ip,
-			Domain: domain,
-			TS:     time.Now(),
+			IP:      d.ip,
+			Domain:  domain,
+			List:    list,
+			Chain:   d.chain,
+			Source:  d.source,
+			Tag:     d.tag,
+			TS:      now,
+			Expires: now.Add(ttlPol.lifetime(d.ttl)),
 		}
 
-		addEntry(e, true)
-
-		if syncer != nil {
-			if err := syncer.broadcast(e); err != nil {
-				log.Printf("Unable to broadcast [%s %s]: %s", ip, domain, err)
-			}
-		}
+		publish(e, true)
+		return true
 	}
 
 	dnsTapErrorCb := func(err error) {
 		log.Printf("DNSTap error: %s", err)
 	}
 
-	if _, err = newDnstapServer(cfg.DNSTap, addHostCb, dnsTapErrorCb); err != nil {
-		log.Fatalf("Unable to init DNSTap: %s", err)
+	for _, c := range dnstapCfgs {
+		if _, err = newDnstapServer(c, addHostCb, dnsTapErrorCb); err != nil {
+			log.Fatalf("Unable to init DNSTap: %s", err)
+		}
+
+		log.Printf("Listening for DNSTap on: %s (tag: '%s')", c.Listen, c.Tag)
+	}
+
+	if cfg.Proxy != nil {
+		if _, err = newProxy(cfg.Proxy, addHostCb); err != nil {
+			log.Fatalf("Unable to init DNS proxy: %s", err)
+		}
+
+		log.Printf("Listening for DNS queries on: %s, upstreams: %v", cfg.Proxy.Listen, cfg.Proxy.Upstreams)
+	}
+
+	for _, c := range cfg.PowerDNS {
+		if _, err = newPdnsServer(c, addHostCb); err != nil {
+			log.Fatalf("Unable to init PowerDNS listener: %s", err)
+		}
+
+		log.Printf("Listening for PowerDNS protobuf on: %s (tag: '%s')", c.Listen, c.Tag)
+	}
+
+	if cfg.Admin != nil {
+		drop := func(e, next *cacheEntry) {
+			dropRef(e, next)
+			tombstone(e, time.Now())
+		}
+
+		if _, err = newAdmin(cfg.Admin, ipCache, dLists, publish, drop, ttlPol); err != nil {
+			log.Fatalf("Unable to init admin API: %s", err)
+		}
+
+		log.Printf("Serving admin API on: %s", cfg.Admin.Listen)
+	}
+
+	if cfg.Metrics != nil {
+		if err = newMetrics(cfg.Metrics, ipCache, bgp); err != nil {
+			log.Fatalf("Unable to init metrics: %s", err)
+		}
+
+		log.Printf("Serving metrics on: %s", cfg.Metrics.Listen)
 	}
 
-	log.Printf("Listening for DNSTap on: %s", cfg.DNSTap.Listen)
+	// The paths are already in place, so the BGP sessions come up announcing the whole set
+	if cfg.Bootstrap != nil {
+		if err = bootstrap(cfg.Bootstrap, syncer, dLists, addEntry); err != nil {
+			log.Fatalf("Unable to bootstrap: %s", err)
+		}
+	}
+
+	if err = bgp.start(); err != nil {
+		log.Fatalf("Unable to start BGP: %s", err)
+	}
 
 	go func() {
 		sigchannel := make(chan os.Signal, 1)
@@ -197,17 +493,64 @@ func main() {
 		for sig := range sigchannel {
 			switch sig {
 			case syscall.SIGHUP:
-				if i, s, err := dTree.loadFile(cfg.Domains); err != nil {
+				i, s, err := dLists.loadFiles()
+				if err != nil {
 					log.Printf("Unable to load file: %s", err)
-				} else {
-					log.Printf("Domains loaded: %d, skipped: %d", i, s)
+					break
 				}
 
+				matches := func(e *cacheEntry) bool {
+					_, ok := dLists.match(e.Domain, e.Tag)
+					return ok
+				}
+
+				// The domains which moved to another list are re-announced with its policy
+				m := ipCache.relist(func(e *cacheEntry) (string, bool) {
+					return dLists.match(e.Domain, e.Tag)
+				}, func(e, ne *cacheEntry, ann bool) {
+					if ann {
+						if err := bgp.moveHost(e.IP, e.List, ne.List); err != nil {
+							log.Printf("Unable to re-announce %s: %s", e.IP, err)
+						}
+					}
+
+					ipDBPut(ne)
+					log.Printf("%s (%s) moved from list %q to %q", e.IP, e.Domain, e.List, ne.List)
+				})
+
+				if !cfg.WithdrawOnReload {
+					n := 0
+					for _, e := range ipCache.getAll() {
+						if !matches(e) {
+							n++
+						}
+					}
+
+					log.Printf("Domains loaded: %d, skipped: %d, references moved: %d, stale references left to expire: %d", i, s, m, n)
+					break
+				}
+
+				w := 0
+				n := ipCache.purge(func(e *cacheEntry) bool {
+					return !matches(e)
+				}, func(e, next *cacheEntry) {
+					withdrawn := dropRef(e, next)
+					if withdrawn {
+						w++
+					}
+
+					tombstone(e, time.Now())
+
+					log.Printf("%s (%s) removed from the lists, withdrawn: %t", e.IP, e.Domain, withdrawn)
+				})
+
+				log.Printf("Domains loaded: %d, skipped: %d, references moved: %d, removed: %d, IPs withdrawn: %d", i, s, m, n, w)
+
 			case os.Interrupt, syscall.SIGTERM:
 				close(shutdown)
 
 			case syscall.SIGUSR1:
-				log.Printf("IPs exported: %d, domains loaded: %d", ipCache.count(), dTree.count())
+				log.Printf("IPs exported: %d, domains loaded: %d", ipCache.count(), dLists.count())
 			}
 		}
 	}()
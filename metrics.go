@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "dnstap_bgp"
+
+type metricsCfg struct {
+	Listen string
+}
+
+var (
+	mDnstapFrames = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "dnstap",
+		Name:      "frames_total",
+		Help:      "DNSTap frames received",
+	})
+
+	mDnstapMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "dnstap",
+		Name:      "messages_total",
+		Help:      "DNSTap messages received, by message type and result: accepted or ignored",
+	}, []string{"type", "result"})
+
+	mDnstapErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "dnstap",
+		Name:      "errors_total",
+		Help:      "DNSTap frames which failed to decode, by stage: unmarshal or unpack",
+	}, []string{"stage"})
+
+	mDnstapRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "dnstap",
+		Name:      "rejected_connections_total",
+		Help:      "DNSTap and PowerDNS connections rejected, by reason: address or tls",
+	}, []string{"reason"})
+
+	mReplies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "replies_total",
+		Help:      "DNS replies with addresses by source (dnstap, proxy or pdns) which matched or didn't match the domain lists",
+	}, []string{"source", "result"})
+
+	mPdnsMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "pdns",
+		Name:      "messages_total",
+		Help:      "PowerDNS protobuf messages received, by message type and result: accepted or ignored",
+	}, []string{"type", "result"})
+
+	mPdnsErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "pdns",
+		Name:      "errors_total",
+		Help:      "PowerDNS protobuf messages which failed to decode, by stage: read or unmarshal",
+	}, []string{"stage"})
+
+	mProxyQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "proxy",
+		Name:      "queries_total",
+		Help:      "DNS queries to the proxy, by result: ok, error if no upstream replied or refused if the client isn't allowed",
+	}, []string{"result"})
+
+	mCacheExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "cache",
+		Name:      "expired_total",
+		Help:      "Domain references expired from the cache",
+	})
+
+	mBGPErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "bgp",
+		Name:      "errors_total",
+		Help:      "BGP path operations which failed, by operation: add or delete",
+	}, []string{"op"})
+
+	mDBWrite = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "db",
+		Name:      "write_duration_seconds",
+		Help:      "Latency of the DB writes",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+
+	mDBErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "db",
+		Name:      "errors_total",
+		Help:      "DB writes which failed, by operation: add, delete or change (the change log)",
+	}, []string{"op"})
+
+	mSyncerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "syncer",
+		Name:      "requests_total",
+		Help:      "Requests to the syncer peers, by operation (push, fetch or changes over HTTP, push, pull or watch over gRPC) and result (ok or error)",
+	}, []string{"peer", "op", "result"})
+
+	mSyncerRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "syncer",
+		Name:      "rejected_total",
+		Help:      "Entries from the peers or the bootstrap snapshot (peer \"snapshot\") rejected, by reason: ip, timestamp, domain or loop",
+	}, []string{"peer", "reason"})
+
+	mSyncerQueue = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "syncer",
+		Name:      "queue_length",
+		Help:      "Entries queued to be pushed to the peer",
+	}, []string{"peer"})
+
+	mSyncerDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "syncer",
+		Name:      "dropped_total",
+		Help:      "Entries dropped from the full push queue of the peer",
+	}, []string{"peer"})
+
+	mGossipMembers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "gossip",
+		Name:      "members",
+		Help:      "Alive members of the gossip cluster, not counting this instance",
+	})
+
+	mGossipEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "gossip",
+		Name:      "events_total",
+		Help:      "Gossip membership changes, by event: join, leave or update",
+	}, []string{"event"})
+)
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "ok"
+}
+
+// cacheCollector reports the number of cached IPs per address family on scrape
+type cacheCollector struct {
+	c *cache
+	d *prometheus.Desc
+}
+
+func (cc *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cc.d
+}
+
+func (cc *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	v4, v6 := cc.c.countFamily()
+	ch <- prometheus.MustNewConstMetric(cc.d, prometheus.GaugeValue, float64(v4), "ipv4")
+	ch <- prometheus.MustNewConstMetric(cc.d, prometheus.GaugeValue, float64(v6), "ipv6")
+}
+
+// bgpCollector reports the session state of the BGP peers on scrape
+type bgpCollector struct {
+	b *bgpServer
+	d *prometheus.Desc
+}
+
+func (bc *bgpCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bc.d
+}
+
+func (bc *bgpCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+
+	bc.b.s.ListPeer(ctx, &api.ListPeerRequest{}, func(p *api.Peer) {
+		if p.State == nil {
+			return
+		}
+
+		ch <- prometheus.MustNewConstMetric(bc.d, prometheus.GaugeValue, float64(p.State.SessionState), p.Conf.NeighborAddress)
+	})
+}
+
+// newMetrics serves the default registry with the collectors of the cache and BGP added to it
+func newMetrics(c *metricsCfg, ch *cache, b *bgpServer) error {
+	return serveMetrics(c, prometheus.DefaultRegisterer, prometheus.DefaultGatherer, ch, b)
+}
+
+func serveMetrics(c *metricsCfg, reg prometheus.Registerer, g prometheus.Gatherer, ch *cache, b *bgpServer) (err error) {
+	if c.Listen == "" {
+		return fmt.Errorf("you need to specify metrics listening point")
+	}
+
+	if err = reg.Register(&cacheCollector{
+		c: ch,
+		d: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "cache", "ips"),
+			"IPs in the cache by address family",
+			[]string{"family"}, nil,
+		),
+	}); err != nil {
+		return
+	}
+
+	if err = reg.Register(&bgpCollector{
+		b: b,
+		d: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "bgp", "peer_state"),
+			"BGP session state of the peer: 1 - idle, 2 - connect, 3 - active, 4 - opensent, 5 - openconfirm, 6 - established",
+			[]string{"peer"}, nil,
+		),
+	}); err != nil {
+		return
+	}
+
+	l, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(reg, promhttp.HandlerFor(g, promhttp.HandlerOpts{})))
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	return
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Metrics(t *testing.T) {
+	c := newCache(time.Hour, nil, nil)
+	c.add(&cacheEntry{
+		IP:     net.ParseIP("1.2.3.4"),
+		Domain: "foo.bar",
+		TS:     time.Now(),
+	})
+
+	b, err := newBgp(&bgpCfg{
+		AS:       65000,
+		RouterID: "127.0.0.1",
+		Peers: []string{
+			"127.0.0.1",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, b.start())
+	defer b.close()
+
+	assert.NotNil(t, newMetrics(&metricsCfg{}, c, b))
+
+	// A registry of its own, so that the collectors can be registered again on the next run
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(mDBErrors)
+
+	port := rand.Intn(60000) + 2000
+	err = serveMetrics(&metricsCfg{
+		Listen: fmt.Sprintf("127.0.0.1:%d", port),
+	}, reg, reg, c, b)
+	require.Nil(t, err)
+
+	mDBErrors.WithLabelValues("add").Inc()
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", port))
+	require.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	assert.Contains(t, string(body), `dnstap_bgp_cache_ips{family="ipv4"} 1`)
+	assert.Contains(t, string(body), `dnstap_bgp_cache_ips{family="ipv6"} 0`)
+	assert.Contains(t, string(body), `dnstap_bgp_bgp_peer_state{peer="127.0.0.1"}`)
+	assert.Contains(t, string(body), `dnstap_bgp_db_errors_total{op="add"}`)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/blind-oracle/dnstap-bgp/pdnspb"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+type pdnsCfg struct {
+	// IP:Port to listen on for the PowerDNS protobuf stream
+	Listen string
+
+	// Message types to take the responses from, DNSResponseType by default
+	Types []string
+
+	// Stored in the cache entries like the DNSTap listener's tag
+	Tag string
+
+	// Accept the connections only from these prefixes
+	Allow []string
+
+	IPv6 bool
+}
+
+// pdnsServer reads the protobuf messages which PowerDNS Recursor and dnsdist send
+// to their protobufServer: each one is prefixed with its 16-bit length
+type pdnsServer struct {
+	cfg   *pdnsCfg
+	cb    fCb
+	types map[pdnspb.PBDNSMessage_Type]bool
+	l     net.Listener
+}
+
+// parsePdnsTypes parses the names of the response message types
+func parsePdnsTypes(names []string) (types map[pdnspb.PBDNSMessage_Type]bool, err error) {
+	if len(names) == 0 {
+		names = []string{"DNSResponseType"}
+	}
+
+	types = map[pdnspb.PBDNSMessage_Type]bool{}
+	for _, n := range names {
+		v, ok := pdnspb.PBDNSMessage_Type_value[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown PowerDNS message type '%s'", n)
+		}
+
+		if !strings.HasSuffix(n, "ResponseType") {
+			return nil, fmt.Errorf("PowerDNS message type '%s' is not a response", n)
+		}
+
+		types[pdnspb.PBDNSMessage_Type(v)] = true
+	}
+
+	return
+}
+
+func newPdnsServer(c *pdnsCfg, cb fCb) (ps *pdnsServer, err error) {
+	if c.Listen == "" {
+		return nil, fmt.Errorf("you need to specify PowerDNS listening point")
+	}
+
+	ps = &pdnsServer{
+		cfg: c,
+		cb:  cb,
+	}
+
+	if ps.types, err = parsePdnsTypes(c.Types); err != nil {
+		return nil, err
+	}
+
+	l := &dnstapListener{}
+	if l.allow, err = parsePrefixes(c.Allow); err != nil {
+		return nil, fmt.Errorf("unable to parse allowed prefixes: %w", err)
+	}
+
+	if l.Listener, err = net.Listen("tcp", c.Listen); err != nil {
+		return nil, fmt.Errorf("unable to listen on '%s': %w", c.Listen, err)
+	}
+
+	ps.l = l
+	go ps.serve()
+	return
+}
+
+func (ps *pdnsServer) serve() {
+	for {
+		c, err := ps.l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Printf("PowerDNS: accept failed: %s", err)
+			continue
+		}
+
+		go ps.handleConn(c)
+	}
+}
+
+func (ps *pdnsServer) handleConn(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	buf := make([]byte, 65535)
+
+	for {
+		var n uint16
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			if err != io.EOF {
+				mPdnsErrors.WithLabelValues("read").Inc()
+				log.Printf("PowerDNS: unable to read from %s: %s", c.RemoteAddr(), err)
+			}
+
+			return
+		}
+
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			mPdnsErrors.WithLabelValues("read").Inc()
+			log.Printf("PowerDNS: unable to read from %s: %s", c.RemoteAddr(), err)
+			return
+		}
+
+		msg := &pdnspb.PBDNSMessage{}
+		if err := proto.Unmarshal(buf[:n], msg); err != nil {
+			mPdnsErrors.WithLabelValues("unmarshal").Inc()
+			log.Printf("PowerDNS: unmarshal failed: %s", err)
+			continue
+		}
+
+		ps.handleMsg(msg)
+	}
+}
+
+func (ps *pdnsServer) handleMsg(msg *pdnspb.PBDNSMessage) {
+	if !ps.types[msg.GetType()] || msg.Response == nil {
+		mPdnsMessages.WithLabelValues(msg.GetType().String(), "ignored").Inc()
+		return
+	}
+
+	mPdnsMessages.WithLabelValues(msg.GetType().String(), "accepted").Inc()
+
+	if msg.Response.GetRcode() != dns.RcodeSuccess {
+		return
+	}
+
+	handleReply(pdnsReply(msg.Response), ps.cfg.IPv6, "pdns", ps.cfg.Tag, ps.cb)
+}
+
+// pdnsReply converts the exported records to a DNS message. PowerDNS exports
+// only some types (by default A, AAAA and CNAME), the others are skipped.
+func pdnsReply(r *pdnspb.PBDNSMessage_DNSResponse) *dns.Msg {
+	m := &dns.Msg{}
+
+	for _, rr := range r.GetRrs() {
+		hdr := dns.RR_Header{
+			Name:   dns.Fqdn(rr.GetName()),
+			Rrtype: uint16(rr.GetType()),
+			Class:  uint16(rr.GetClass()),
+			Ttl:    rr.GetTtl(),
+		}
+
+		switch hdr.Rrtype {
+		case dns.TypeA:
+			if len(rr.Rdata) == net.IPv4len {
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IP(rr.Rdata)})
+			}
+
+		case dns.TypeAAAA:
+			if len(rr.Rdata) == net.IPv6len {
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IP(rr.Rdata)})
+			}
+
+		case dns.TypeCNAME:
+			m.Answer = append(m.Answer, &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(string(rr.Rdata))})
+		}
+	}
+
+	return m
+}
+
+func (ps *pdnsServer) close() error {
+	return ps.l.Close()
+}
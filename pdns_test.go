@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blind-oracle/dnstap-bgp/pdnspb"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func pdnsRR(name string, typ uint16, rdata []byte) *pdnspb.PBDNSMessage_DNSResponse_DNSRR {
+	return &pdnspb.PBDNSMessage_DNSResponse_DNSRR{
+		Name:  proto.String(name),
+		Type:  proto.Uint32(uint32(typ)),
+		Class: proto.Uint32(dns.ClassINET),
+		Ttl:   proto.Uint32(60),
+		Rdata: rdata,
+	}
+}
+
+func Test_parsePdnsTypes(t *testing.T) {
+	ts, err := parsePdnsTypes(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[pdnspb.PBDNSMessage_Type]bool{pdnspb.PBDNSMessage_DNSResponseType: true}, ts)
+
+	ts, err = parsePdnsTypes([]string{"DNSIncomingResponseType"})
+	assert.Nil(t, err)
+	assert.True(t, ts[pdnspb.PBDNSMessage_DNSIncomingResponseType])
+
+	_, err = parsePdnsTypes([]string{"DNSQueryType"})
+	assert.NotNil(t, err)
+	_, err = parsePdnsTypes([]string{"foo"})
+	assert.NotNil(t, err)
+}
+
+func Test_pdnsReply(t *testing.T) {
+	m := pdnsReply(&pdnspb.PBDNSMessage_DNSResponse{
+		Rrs: []*pdnspb.PBDNSMessage_DNSResponse_DNSRR{
+			pdnsRR("www.foo.bar.", dns.TypeCNAME, []byte("edge.cdn.net.")),
+			pdnsRR("edge.cdn.net.", dns.TypeA, net.ParseIP("1.2.3.4").To4()),
+			pdnsRR("edge.cdn.net.", dns.TypeAAAA, net.ParseIP("2001:db8::1")),
+			// Broken address and unsupported type
+			pdnsRR("edge.cdn.net.", dns.TypeA, []byte{1, 2}),
+			pdnsRR("edge.cdn.net.", dns.TypeTXT, []byte("foo")),
+		},
+	})
+
+	es := parseDNSReply(m, true)
+	assert.Len(t, es, 2)
+	assert.Equal(t, "www.foo.bar.", es[0].chain[0])
+	assert.Equal(t, uint32(60), es[0].ttl)
+	assert.Equal(t, []string{"www.foo.bar.", "edge.cdn.net."}, es[0].chain)
+	assert.Equal(t, net.ParseIP("1.2.3.4").To4(), es[0].ip)
+	assert.Equal(t, net.ParseIP("2001:db8::1"), es[1].ip)
+}
+
+func Test_pdnsServer(t *testing.T) {
+	ch := make(chan *dnsEntry, 2)
+	cb := func(d *dnsEntry) bool {
+		ch <- d
+		return true
+	}
+
+	ps, err := newPdnsServer(&pdnsCfg{Listen: "127.0.0.1:0", Tag: "rec"}, cb)
+	assert.Nil(t, err)
+	defer ps.close()
+
+	c, err := net.Dial("tcp", ps.l.Addr().String())
+	assert.Nil(t, err)
+	defer c.Close()
+
+	send := func(msg *pdnspb.PBDNSMessage) {
+		b, err := proto.Marshal(msg)
+		assert.Nil(t, err)
+		assert.Nil(t, binary.Write(c, binary.BigEndian, uint16(len(b))))
+		_, err = c.Write(b)
+		assert.Nil(t, err)
+	}
+
+	resp := func(typ pdnspb.PBDNSMessage_Type, name string) *pdnspb.PBDNSMessage {
+		return &pdnspb.PBDNSMessage{
+			Type: typ.Enum(),
+			Response: &pdnspb.PBDNSMessage_DNSResponse{
+				Rcode: proto.Uint32(dns.RcodeSuccess),
+				Rrs:   []*pdnspb.PBDNSMessage_DNSResponse_DNSRR{pdnsRR(name, dns.TypeA, net.ParseIP("1.2.3.4").To4())},
+			},
+		}
+	}
+
+	ignored := testutil.ToFloat64(mPdnsMessages.WithLabelValues("DNSQueryType", "ignored"))
+
+	send(&pdnspb.PBDNSMessage{Type: pdnspb.PBDNSMessage_DNSQueryType.Enum()})
+	send(resp(pdnspb.PBDNSMessage_DNSIncomingResponseType, "outgoing.foo."))
+	send(resp(pdnspb.PBDNSMessage_DNSResponseType, "foo.bar."))
+
+	d := <-ch
+	assert.Equal(t, "foo.bar", d.chain[0])
+	assert.Equal(t, "pdns", d.source)
+	assert.Equal(t, "rec", d.tag)
+	assert.Equal(t, ignored+1, testutil.ToFloat64(mPdnsMessages.WithLabelValues("DNSQueryType", "ignored")))
+
+	// Garbage doesn't break the stream
+	assert.Nil(t, binary.Write(c, binary.BigEndian, uint16(3)))
+	_, err = c.Write([]byte{0xff, 0xff, 0xff})
+	assert.Nil(t, err)
+	send(resp(pdnspb.PBDNSMessage_DNSResponseType, "bar.foo."))
+
+	select {
+	case d = <-ch:
+		assert.Equal(t, "bar.foo", d.chain[0])
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply after garbage")
+	}
+}
@@ -0,0 +1,567 @@
+// The part of PowerDNS dnsmessage.proto which is needed to take the addresses from the responses,
+// the other fields are skipped when decoding
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.30.0
+// 	protoc        (unknown)
+// source: dnsmessage.proto
+
+package pdnspb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type PBDNSMessage_Type int32
+
+const (
+	PBDNSMessage_DNSQueryType            PBDNSMessage_Type = 1
+	PBDNSMessage_DNSResponseType         PBDNSMessage_Type = 2
+	PBDNSMessage_DNSOutgoingQueryType    PBDNSMessage_Type = 3
+	PBDNSMessage_DNSIncomingResponseType PBDNSMessage_Type = 4
+)
+
+// Enum value maps for PBDNSMessage_Type.
+var (
+	PBDNSMessage_Type_name = map[int32]string{
+		1: "DNSQueryType",
+		2: "DNSResponseType",
+		3: "DNSOutgoingQueryType",
+		4: "DNSIncomingResponseType",
+	}
+	PBDNSMessage_Type_value = map[string]int32{
+		"DNSQueryType":            1,
+		"DNSResponseType":         2,
+		"DNSOutgoingQueryType":    3,
+		"DNSIncomingResponseType": 4,
+	}
+)
+
+func (x PBDNSMessage_Type) Enum() *PBDNSMessage_Type {
+	p := new(PBDNSMessage_Type)
+	*p = x
+	return p
+}
+
+func (x PBDNSMessage_Type) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (PBDNSMessage_Type) Descriptor() protoreflect.EnumDescriptor {
+	return file_dnsmessage_proto_enumTypes[0].Descriptor()
+}
+
+func (PBDNSMessage_Type) Type() protoreflect.EnumType {
+	return &file_dnsmessage_proto_enumTypes[0]
+}
+
+func (x PBDNSMessage_Type) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Do not use.
+func (x *PBDNSMessage_Type) UnmarshalJSON(b []byte) error {
+	num, err := protoimpl.X.UnmarshalJSONEnum(x.Descriptor(), b)
+	if err != nil {
+		return err
+	}
+	*x = PBDNSMessage_Type(num)
+	return nil
+}
+
+// Deprecated: Use PBDNSMessage_Type.Descriptor instead.
+func (PBDNSMessage_Type) EnumDescriptor() ([]byte, []int) {
+	return file_dnsmessage_proto_rawDescGZIP(), []int{0, 0}
+}
+
+type PBDNSMessage struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Type           *PBDNSMessage_Type        `protobuf:"varint,1,opt,name=type,enum=PBDNSMessage_Type" json:"type,omitempty"`
+	MessageId      []byte                    `protobuf:"bytes,2,opt,name=messageId" json:"messageId,omitempty"`
+	ServerIdentity []byte                    `protobuf:"bytes,3,opt,name=serverIdentity" json:"serverIdentity,omitempty"`
+	From           []byte                    `protobuf:"bytes,6,opt,name=from" json:"from,omitempty"`
+	To             []byte                    `protobuf:"bytes,7,opt,name=to" json:"to,omitempty"`
+	TimeSec        *uint32                   `protobuf:"varint,9,opt,name=timeSec" json:"timeSec,omitempty"`
+	TimeUsec       *uint32                   `protobuf:"varint,10,opt,name=timeUsec" json:"timeUsec,omitempty"`
+	Id             *uint32                   `protobuf:"varint,11,opt,name=id" json:"id,omitempty"`
+	Question       *PBDNSMessage_DNSQuestion `protobuf:"bytes,12,opt,name=question" json:"question,omitempty"`
+	Response       *PBDNSMessage_DNSResponse `protobuf:"bytes,13,opt,name=response" json:"response,omitempty"`
+}
+
+func (x *PBDNSMessage) Reset() {
+	*x = PBDNSMessage{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_dnsmessage_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PBDNSMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PBDNSMessage) ProtoMessage() {}
+
+func (x *PBDNSMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_dnsmessage_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PBDNSMessage.ProtoReflect.Descriptor instead.
+func (*PBDNSMessage) Descriptor() ([]byte, []int) {
+	return file_dnsmessage_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *PBDNSMessage) GetType() PBDNSMessage_Type {
+	if x != nil && x.Type != nil {
+		return *x.Type
+	}
+	return PBDNSMessage_DNSQueryType
+}
+
+func (x *PBDNSMessage) GetMessageId() []byte {
+	if x != nil {
+		return x.MessageId
+	}
+	return nil
+}
+
+func (x *PBDNSMessage) GetServerIdentity() []byte {
+	if x != nil {
+		return x.ServerIdentity
+	}
+	return nil
+}
+
+func (x *PBDNSMessage) GetFrom() []byte {
+	if x != nil {
+		return x.From
+	}
+	return nil
+}
+
+func (x *PBDNSMessage) GetTo() []byte {
+	if x != nil {
+		return x.To
+	}
+	return nil
+}
+
+func (x *PBDNSMessage) GetTimeSec() uint32 {
+	if x != nil && x.TimeSec != nil {
+		return *x.TimeSec
+	}
+	return 0
+}
+
+func (x *PBDNSMessage) GetTimeUsec() uint32 {
+	if x != nil && x.TimeUsec != nil {
+		return *x.TimeUsec
+	}
+	return 0
+}
+
+func (x *PBDNSMessage) GetId() uint32 {
+	if x != nil && x.Id != nil {
+		return *x.Id
+	}
+	return 0
+}
+
+func (x *PBDNSMessage) GetQuestion() *PBDNSMessage_DNSQuestion {
+	if x != nil {
+		return x.Question
+	}
+	return nil
+}
+
+func (x *PBDNSMessage) GetResponse() *PBDNSMessage_DNSResponse {
+	if x != nil {
+		return x.Response
+	}
+	return nil
+}
+
+type PBDNSMessage_DNSQuestion struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	QName  *string `protobuf:"bytes,1,opt,name=qName" json:"qName,omitempty"`
+	QType  *uint32 `protobuf:"varint,2,opt,name=qType" json:"qType,omitempty"`
+	QClass *uint32 `protobuf:"varint,3,opt,name=qClass" json:"qClass,omitempty"`
+}
+
+func (x *PBDNSMessage_DNSQuestion) Reset() {
+	*x = PBDNSMessage_DNSQuestion{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_dnsmessage_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PBDNSMessage_DNSQuestion) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PBDNSMessage_DNSQuestion) ProtoMessage() {}
+
+func (x *PBDNSMessage_DNSQuestion) ProtoReflect() protoreflect.Message {
+	mi := &file_dnsmessage_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PBDNSMessage_DNSQuestion.ProtoReflect.Descriptor instead.
+func (*PBDNSMessage_DNSQuestion) Descriptor() ([]byte, []int) {
+	return file_dnsmessage_proto_rawDescGZIP(), []int{0, 0}
+}
+
+func (x *PBDNSMessage_DNSQuestion) GetQName() string {
+	if x != nil && x.QName != nil {
+		return *x.QName
+	}
+	return ""
+}
+
+func (x *PBDNSMessage_DNSQuestion) GetQType() uint32 {
+	if x != nil && x.QType != nil {
+		return *x.QType
+	}
+	return 0
+}
+
+func (x *PBDNSMessage_DNSQuestion) GetQClass() uint32 {
+	if x != nil && x.QClass != nil {
+		return *x.QClass
+	}
+	return 0
+}
+
+type PBDNSMessage_DNSResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Rcode *uint32                           `protobuf:"varint,1,opt,name=rcode" json:"rcode,omitempty"`
+	Rrs   []*PBDNSMessage_DNSResponse_DNSRR `protobuf:"bytes,2,rep,name=rrs" json:"rrs,omitempty"`
+}
+
+func (x *PBDNSMessage_DNSResponse) Reset() {
+	*x = PBDNSMessage_DNSResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_dnsmessage_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PBDNSMessage_DNSResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PBDNSMessage_DNSResponse) ProtoMessage() {}
+
+func (x *PBDNSMessage_DNSResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_dnsmessage_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PBDNSMessage_DNSResponse.ProtoReflect.Descriptor instead.
+func (*PBDNSMessage_DNSResponse) Descriptor() ([]byte, []int) {
+	return file_dnsmessage_proto_rawDescGZIP(), []int{0, 1}
+}
+
+func (x *PBDNSMessage_DNSResponse) GetRcode() uint32 {
+	if x != nil && x.Rcode != nil {
+		return *x.Rcode
+	}
+	return 0
+}
+
+func (x *PBDNSMessage_DNSResponse) GetRrs() []*PBDNSMessage_DNSResponse_DNSRR {
+	if x != nil {
+		return x.Rrs
+	}
+	return nil
+}
+
+// The rdata is the address for A and AAAA, the target name for CNAME
+type PBDNSMessage_DNSResponse_DNSRR struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name  *string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Type  *uint32 `protobuf:"varint,2,opt,name=type" json:"type,omitempty"`
+	Class *uint32 `protobuf:"varint,3,opt,name=class" json:"class,omitempty"`
+	Ttl   *uint32 `protobuf:"varint,4,opt,name=ttl" json:"ttl,omitempty"`
+	Rdata []byte  `protobuf:"bytes,5,opt,name=rdata" json:"rdata,omitempty"`
+}
+
+func (x *PBDNSMessage_DNSResponse_DNSRR) Reset() {
+	*x = PBDNSMessage_DNSResponse_DNSRR{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_dnsmessage_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PBDNSMessage_DNSResponse_DNSRR) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PBDNSMessage_DNSResponse_DNSRR) ProtoMessage() {}
+
+func (x *PBDNSMessage_DNSResponse_DNSRR) ProtoReflect() protoreflect.Message {
+	mi := &file_dnsmessage_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PBDNSMessage_DNSResponse_DNSRR.ProtoReflect.Descriptor instead.
+func (*PBDNSMessage_DNSResponse_DNSRR) Descriptor() ([]byte, []int) {
+	return file_dnsmessage_proto_rawDescGZIP(), []int{0, 1, 0}
+}
+
+func (x *PBDNSMessage_DNSResponse_DNSRR) GetName() string {
+	if x != nil && x.Name != nil {
+		return *x.Name
+	}
+	return ""
+}
+
+func (x *PBDNSMessage_DNSResponse_DNSRR) GetType() uint32 {
+	if x != nil && x.Type != nil {
+		return *x.Type
+	}
+	return 0
+}
+
+func (x *PBDNSMessage_DNSResponse_DNSRR) GetClass() uint32 {
+	if x != nil && x.Class != nil {
+		return *x.Class
+	}
+	return 0
+}
+
+func (x *PBDNSMessage_DNSResponse_DNSRR) GetTtl() uint32 {
+	if x != nil && x.Ttl != nil {
+		return *x.Ttl
+	}
+	return 0
+}
+
+func (x *PBDNSMessage_DNSResponse_DNSRR) GetRdata() []byte {
+	if x != nil {
+		return x.Rdata
+	}
+	return nil
+}
+
+var File_dnsmessage_proto protoreflect.FileDescriptor
+
+var file_dnsmessage_proto_rawDesc = []byte{
+	0x0a, 0x10, 0x64, 0x6e, 0x73, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x22, 0xd5, 0x05, 0x0a, 0x0c, 0x50, 0x42, 0x44, 0x4e, 0x53, 0x4d, 0x65, 0x73, 0x73,
+	0x61, 0x67, 0x65, 0x12, 0x26, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x0e, 0x32, 0x12, 0x2e, 0x50, 0x42, 0x44, 0x4e, 0x53, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65,
+	0x2e, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x6d,
+	0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x49, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09,
+	0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x49, 0x64, 0x12, 0x26, 0x0a, 0x0e, 0x73, 0x65, 0x72,
+	0x76, 0x65, 0x72, 0x49, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x0c, 0x52, 0x0e, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x49, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x74,
+	0x79, 0x12, 0x12, 0x0a, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0c, 0x52,
+	0x04, 0x66, 0x72, 0x6f, 0x6d, 0x12, 0x0e, 0x0a, 0x02, 0x74, 0x6f, 0x18, 0x07, 0x20, 0x01, 0x28,
+	0x0c, 0x52, 0x02, 0x74, 0x6f, 0x12, 0x18, 0x0a, 0x07, 0x74, 0x69, 0x6d, 0x65, 0x53, 0x65, 0x63,
+	0x18, 0x09, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x74, 0x69, 0x6d, 0x65, 0x53, 0x65, 0x63, 0x12,
+	0x1a, 0x0a, 0x08, 0x74, 0x69, 0x6d, 0x65, 0x55, 0x73, 0x65, 0x63, 0x18, 0x0a, 0x20, 0x01, 0x28,
+	0x0d, 0x52, 0x08, 0x74, 0x69, 0x6d, 0x65, 0x55, 0x73, 0x65, 0x63, 0x12, 0x0e, 0x0a, 0x02, 0x69,
+	0x64, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x02, 0x69, 0x64, 0x12, 0x35, 0x0a, 0x08, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e,
+	0x50, 0x42, 0x44, 0x4e, 0x53, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2e, 0x44, 0x4e, 0x53,
+	0x51, 0x75, 0x65, 0x73, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x08, 0x71, 0x75, 0x65, 0x73, 0x74, 0x69,
+	0x6f, 0x6e, 0x12, 0x35, 0x0a, 0x08, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x0d,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x50, 0x42, 0x44, 0x4e, 0x53, 0x4d, 0x65, 0x73, 0x73,
+	0x61, 0x67, 0x65, 0x2e, 0x44, 0x4e, 0x53, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x52,
+	0x08, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x1a, 0x51, 0x0a, 0x0b, 0x44, 0x4e, 0x53,
+	0x51, 0x75, 0x65, 0x73, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x14, 0x0a, 0x05, 0x71, 0x4e, 0x61, 0x6d,
+	0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x71, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x14,
+	0x0a, 0x05, 0x71, 0x54, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x05, 0x71,
+	0x54, 0x79, 0x70, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x71, 0x43, 0x6c, 0x61, 0x73, 0x73, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x71, 0x43, 0x6c, 0x61, 0x73, 0x73, 0x1a, 0xc5, 0x01, 0x0a,
+	0x0b, 0x44, 0x4e, 0x53, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x14, 0x0a, 0x05,
+	0x72, 0x63, 0x6f, 0x64, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x05, 0x72, 0x63, 0x6f,
+	0x64, 0x65, 0x12, 0x31, 0x0a, 0x03, 0x72, 0x72, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32,
+	0x1f, 0x2e, 0x50, 0x42, 0x44, 0x4e, 0x53, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2e, 0x44,
+	0x4e, 0x53, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e, 0x44, 0x4e, 0x53, 0x52, 0x52,
+	0x52, 0x03, 0x72, 0x72, 0x73, 0x1a, 0x6d, 0x0a, 0x05, 0x44, 0x4e, 0x53, 0x52, 0x52, 0x12, 0x12,
+	0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61,
+	0x6d, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d,
+	0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x63, 0x6c, 0x61, 0x73, 0x73, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x05, 0x63, 0x6c, 0x61, 0x73, 0x73, 0x12, 0x10, 0x0a, 0x03,
+	0x74, 0x74, 0x6c, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x03, 0x74, 0x74, 0x6c, 0x12, 0x14,
+	0x0a, 0x05, 0x72, 0x64, 0x61, 0x74, 0x61, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x05, 0x72,
+	0x64, 0x61, 0x74, 0x61, 0x22, 0x64, 0x0a, 0x04, 0x54, 0x79, 0x70, 0x65, 0x12, 0x10, 0x0a, 0x0c,
+	0x44, 0x4e, 0x53, 0x51, 0x75, 0x65, 0x72, 0x79, 0x54, 0x79, 0x70, 0x65, 0x10, 0x01, 0x12, 0x13,
+	0x0a, 0x0f, 0x44, 0x4e, 0x53, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x54, 0x79, 0x70,
+	0x65, 0x10, 0x02, 0x12, 0x18, 0x0a, 0x14, 0x44, 0x4e, 0x53, 0x4f, 0x75, 0x74, 0x67, 0x6f, 0x69,
+	0x6e, 0x67, 0x51, 0x75, 0x65, 0x72, 0x79, 0x54, 0x79, 0x70, 0x65, 0x10, 0x03, 0x12, 0x1b, 0x0a,
+	0x17, 0x44, 0x4e, 0x53, 0x49, 0x6e, 0x63, 0x6f, 0x6d, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x54, 0x79, 0x70, 0x65, 0x10, 0x04, 0x42, 0x2b, 0x5a, 0x29, 0x67, 0x69,
+	0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x62, 0x6c, 0x69, 0x6e, 0x64, 0x2d, 0x6f,
+	0x72, 0x61, 0x63, 0x6c, 0x65, 0x2f, 0x64, 0x6e, 0x73, 0x74, 0x61, 0x70, 0x2d, 0x62, 0x67, 0x70,
+	0x2f, 0x70, 0x64, 0x6e, 0x73, 0x70, 0x62,
+}
+
+var (
+	file_dnsmessage_proto_rawDescOnce sync.Once
+	file_dnsmessage_proto_rawDescData = file_dnsmessage_proto_rawDesc
+)
+
+func file_dnsmessage_proto_rawDescGZIP() []byte {
+	file_dnsmessage_proto_rawDescOnce.Do(func() {
+		file_dnsmessage_proto_rawDescData = protoimpl.X.CompressGZIP(file_dnsmessage_proto_rawDescData)
+	})
+	return file_dnsmessage_proto_rawDescData
+}
+
+var file_dnsmessage_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_dnsmessage_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_dnsmessage_proto_goTypes = []interface{}{
+	(PBDNSMessage_Type)(0),                 // 0: PBDNSMessage.Type
+	(*PBDNSMessage)(nil),                   // 1: PBDNSMessage
+	(*PBDNSMessage_DNSQuestion)(nil),       // 2: PBDNSMessage.DNSQuestion
+	(*PBDNSMessage_DNSResponse)(nil),       // 3: PBDNSMessage.DNSResponse
+	(*PBDNSMessage_DNSResponse_DNSRR)(nil), // 4: PBDNSMessage.DNSResponse.DNSRR
+}
+var file_dnsmessage_proto_depIdxs = []int32{
+	0, // 0: PBDNSMessage.type:type_name -> PBDNSMessage.Type
+	2, // 1: PBDNSMessage.question:type_name -> PBDNSMessage.DNSQuestion
+	3, // 2: PBDNSMessage.response:type_name -> PBDNSMessage.DNSResponse
+	4, // 3: PBDNSMessage.DNSResponse.rrs:type_name -> PBDNSMessage.DNSResponse.DNSRR
+	4, // [4:4] is the sub-list for method output_type
+	4, // [4:4] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_dnsmessage_proto_init() }
+func file_dnsmessage_proto_init() {
+	if File_dnsmessage_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_dnsmessage_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PBDNSMessage); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_dnsmessage_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PBDNSMessage_DNSQuestion); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_dnsmessage_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PBDNSMessage_DNSResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_dnsmessage_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PBDNSMessage_DNSResponse_DNSRR); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_dnsmessage_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_dnsmessage_proto_goTypes,
+		DependencyIndexes: file_dnsmessage_proto_depIdxs,
+		EnumInfos:         file_dnsmessage_proto_enumTypes,
+		MessageInfos:      file_dnsmessage_proto_msgTypes,
+	}.Build()
+	File_dnsmessage_proto = out.File
+	file_dnsmessage_proto_rawDesc = nil
+	file_dnsmessage_proto_goTypes = nil
+	file_dnsmessage_proto_depIdxs = nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type proxyCfg struct {
+	// Where to listen for the DNS queries, both UDP and TCP
+	Listen string
+
+	// Servers to forward the queries to in host:port format, tried in order
+	Upstreams []string
+
+	// How long to wait for each upstream
+	Timeout string
+
+	// Stored in the cache entries like the DNSTap listener's tag
+	Tag string
+
+	// Serve only the clients from these prefixes, the others are refused
+	Allow []string
+
+	IPv6 bool
+}
+
+// dnsProxy forwards the queries to the upstreams and takes the addresses
+// from their replies, for the DNS servers which don't support DNSTap
+type dnsProxy struct {
+	cfg       *proxyCfg
+	cb        fCb
+	upstreams []string
+	clients   map[string]*dns.Client
+	allow     []*net.IPNet
+
+	udp *dns.Server
+	tcp *dns.Server
+}
+
+func newProxy(cf *proxyCfg, cb fCb) (p *dnsProxy, err error) {
+	if cf.Listen == "" {
+		return nil, fmt.Errorf("you need to specify proxy listening point")
+	}
+
+	if len(cf.Upstreams) == 0 {
+		return nil, fmt.Errorf("you need to specify at least one upstream")
+	}
+
+	p = &dnsProxy{
+		cfg:     cf,
+		cb:      cb,
+		clients: map[string]*dns.Client{},
+	}
+
+	if p.allow, err = parsePrefixes(cf.Allow); err != nil {
+		return nil, fmt.Errorf("unable to parse allowed prefixes: %w", err)
+	}
+
+	for _, u := range cf.Upstreams {
+		if _, _, err := net.SplitHostPort(u); err != nil {
+			u = net.JoinHostPort(u, "53")
+		}
+
+		p.upstreams = append(p.upstreams, u)
+	}
+
+	timeout := 2 * time.Second
+	if cf.Timeout != "" {
+		if timeout, err = time.ParseDuration(cf.Timeout); err != nil {
+			return nil, fmt.Errorf("unable to parse timeout: %w", err)
+		}
+	}
+
+	for _, n := range []string{"udp", "tcp"} {
+		p.clients[n] = &dns.Client{
+			Net:     n,
+			Timeout: timeout,
+		}
+	}
+
+	pc, err := net.ListenPacket("udp", cf.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on '%s': %w", cf.Listen, err)
+	}
+
+	// The same port for TCP
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("unable to listen on '%s': %w", cf.Listen, err)
+	}
+
+	p.udp = &dns.Server{PacketConn: pc, Handler: p}
+	p.tcp = &dns.Server{Listener: l, Handler: p}
+
+	for _, s := range []*dns.Server{p.udp, p.tcp} {
+		go func(s *dns.Server) {
+			if err := s.ActivateAndServe(); err != nil {
+				log.Fatal(err)
+			}
+		}(s)
+	}
+
+	return
+}
+
+// forward sends the query to the upstreams in turn until one replies
+func (p *dnsProxy) forward(r *dns.Msg, network string) (resp *dns.Msg, err error) {
+	for _, u := range p.upstreams {
+		if resp, _, err = p.clients[network].Exchange(r, u); err == nil {
+			return
+		}
+
+		log.Printf("Proxy: upstream %s failed: %s", u, err)
+	}
+
+	return
+}
+
+// ServeDNS replies to the client and then takes the addresses from the reply
+func (p *dnsProxy) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	network, ip := "udp", net.IP(nil)
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		network, ip = "tcp", a.IP
+	}
+
+	// Not to be an open resolver
+	if len(p.allow) > 0 && !containsIP(p.allow, ip) {
+		mProxyQueries.WithLabelValues("refused").Inc()
+		m := &dns.Msg{}
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	resp, err := p.forward(r, network)
+	if err != nil {
+		mProxyQueries.WithLabelValues("error").Inc()
+		m := &dns.Msg{}
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+
+	mProxyQueries.WithLabelValues("ok").Inc()
+	w.WriteMsg(resp)
+
+	// The client will retry over TCP to get the whole reply
+	if resp.Rcode != dns.RcodeSuccess || resp.Truncated {
+		return
+	}
+
+	handleReply(resp, p.cfg.IPv6, "proxy", p.cfg.Tag, p.cb)
+}
+
+func (p *dnsProxy) close() {
+	p.udp.Shutdown()
+	p.tcp.Shutdown()
+}
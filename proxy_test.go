@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// testUpstream starts a DNS server on UDP and TCP which resolves every name to 1.2.3.4
+func testUpstream(t *testing.T) string {
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := &dns.Msg{}
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("1.2.3.4"),
+		})
+		w.WriteMsg(m)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	assert.Nil(t, err)
+
+	for _, s := range []*dns.Server{{PacketConn: pc, Handler: h}, {Listener: l, Handler: h}} {
+		go s.ActivateAndServe()
+		t.Cleanup(func() { s.Shutdown() })
+	}
+
+	return pc.LocalAddr().String()
+}
+
+func Test_proxy(t *testing.T) {
+	_, err := newProxy(&proxyCfg{Listen: "127.0.0.1:0"}, nil)
+	assert.NotNil(t, err)
+
+	ch := make(chan *dnsEntry, 2)
+	cb := func(d *dnsEntry) bool {
+		ch <- d
+		return true
+	}
+
+	// The first upstream doesn't reply
+	p, err := newProxy(&proxyCfg{
+		Listen:    "127.0.0.1:0",
+		Upstreams: []string{"127.0.0.1:1", testUpstream(t)},
+		Timeout:   "500ms",
+		Tag:       "site",
+		Allow:     []string{"127.0.0.0/8"},
+	}, cb)
+	assert.Nil(t, err)
+	defer p.close()
+
+	addr := p.udp.PacketConn.LocalAddr().String()
+	for _, n := range []string{"udp", "tcp"} {
+		c := &dns.Client{Net: n, Timeout: 5 * time.Second}
+		q := &dns.Msg{}
+		q.SetQuestion("foo.bar.", dns.TypeA)
+
+		r, _, err := c.Exchange(q, addr)
+		assert.Nil(t, err, n)
+		assert.Equal(t, q.Id, r.Id)
+		assert.Len(t, r.Answer, 1)
+
+		d := <-ch
+		assert.Equal(t, "foo.bar", d.chain[0])
+		assert.Equal(t, "proxy", d.source)
+		assert.Equal(t, "site", d.tag)
+		assert.Equal(t, net.ParseIP("1.2.3.4").To4(), d.ip)
+	}
+
+	// The clients not allowed are refused
+	p3, err := newProxy(&proxyCfg{
+		Listen:    "127.0.0.1:0",
+		Upstreams: []string{"127.0.0.1:1"},
+		Allow:     []string{"10.0.0.0/8"},
+	}, cb)
+	assert.Nil(t, err)
+	defer p3.close()
+
+	_, err = newProxy(&proxyCfg{Listen: "127.0.0.1:0", Upstreams: []string{"127.0.0.1:1"}, Allow: []string{"foo"}}, cb)
+	assert.NotNil(t, err)
+
+	refused := testutil.ToFloat64(mProxyQueries.WithLabelValues("refused"))
+	q := &dns.Msg{}
+	q.SetQuestion("foo.bar.", dns.TypeA)
+	r, _, err := (&dns.Client{Timeout: 5 * time.Second}).Exchange(q, p3.udp.PacketConn.LocalAddr().String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeRefused, r.Rcode)
+	assert.Equal(t, refused+1, testutil.ToFloat64(mProxyQueries.WithLabelValues("refused")))
+
+	// No upstreams reply
+	p2, err := newProxy(&proxyCfg{
+		Listen:    "127.0.0.1:0",
+		Upstreams: []string{"127.0.0.1:1"},
+		Timeout:   "100ms",
+	}, cb)
+	assert.Nil(t, err)
+	defer p2.close()
+
+	r, _, err = (&dns.Client{Net: "tcp", Timeout: 5 * time.Second}).Exchange(q, p2.udp.PacketConn.LocalAddr().String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+	assert.Len(t, ch, 0)
+}
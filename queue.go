@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type sendFunc func([]*cacheEntry) (int, error)
+
+// peerQueue buffers the entries to push to a peer and sends them in the background
+// so that a slow or dead peer doesn't block the others. The entries coming in a burst
+// are sent together after a short window or as soon as there's a whole batch.
+// When the queue is full the oldest entries are dropped, the periodic sync will fetch them anyway.
+type peerQueue struct {
+	peer string
+	send sendFunc
+
+	size     int
+	batch    int
+	window   time.Duration
+	retryMin time.Duration
+	retryMax time.Duration
+
+	q      []*cacheEntry
+	notify chan struct{}
+	full   chan struct{}
+	done   chan struct{}
+	sync.Mutex
+}
+
+func newPeerQueue(peer string, send sendFunc, size, batch int, window, retryMin, retryMax time.Duration) (q *peerQueue) {
+	q = &peerQueue{
+		peer:     peer,
+		send:     send,
+		size:     size,
+		batch:    batch,
+		window:   window,
+		retryMin: retryMin,
+		retryMax: retryMax,
+		notify:   make(chan struct{}, 1),
+		full:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	go q.run()
+	return
+}
+
+// trim drops the oldest entries over the size limit, the lock should be held
+func (q *peerQueue) trim() {
+	if n := len(q.q) - q.size; n > 0 {
+		q.q = q.q[n:]
+		mSyncerDropped.WithLabelValues(q.peer).Add(float64(n))
+	}
+
+	mSyncerQueue.WithLabelValues(q.peer).Set(float64(len(q.q)))
+}
+
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (q *peerQueue) push(e *cacheEntry) {
+	q.Lock()
+	q.q = append(q.q, e)
+	q.trim()
+	full := len(q.q) >= q.batch
+	q.Unlock()
+
+	wake(q.notify)
+	if full {
+		wake(q.full)
+	}
+}
+
+// take removes the next batch from the queue
+func (q *peerQueue) take() (es []*cacheEntry) {
+	q.Lock()
+	defer q.Unlock()
+
+	n := len(q.q)
+	if n > q.batch {
+		n = q.batch
+	}
+
+	es = make([]*cacheEntry, n)
+	copy(es, q.q)
+	q.q = q.q[n:]
+	mSyncerQueue.WithLabelValues(q.peer).Set(float64(len(q.q)))
+	return
+}
+
+// requeue puts the unsent entries back to the head of the queue
+func (q *peerQueue) requeue(es []*cacheEntry) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.q = append(es, q.q...)
+	q.trim()
+}
+
+func (q *peerQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.q)
+}
+
+func (q *peerQueue) run() {
+	delay := q.retryMin
+
+	for {
+		select {
+		case <-q.notify:
+		case <-q.done:
+			return
+		}
+
+		if q.window > 0 && q.len() < q.batch {
+			t := time.NewTimer(q.window)
+
+			select {
+			case <-t.C:
+			case <-q.full:
+			case <-q.done:
+				t.Stop()
+				return
+			}
+
+			t.Stop()
+		}
+
+		for {
+			es := q.take()
+			if len(es) == 0 {
+				break
+			}
+
+			n, err := q.send(es)
+			if err == nil {
+				delay = q.retryMin
+				continue
+			}
+
+			q.requeue(es[n:])
+			log.Printf("Syncer: unable to push %d entries to peer %s, retrying in %s: %s", len(es)-n, q.peer, delay, err)
+
+			select {
+			case <-time.After(delay):
+			case <-q.done:
+				return
+			}
+
+			if delay *= 2; delay > q.retryMax {
+				delay = q.retryMax
+			}
+		}
+	}
+}
+
+func (q *peerQueue) close() {
+	close(q.done)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_peerQueue(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		sent    []string
+		batches []int
+		fail    = 2
+		done    = make(chan struct{})
+	)
+
+	send := func(es []*cacheEntry) (int, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		batches = append(batches, len(es))
+		if fail > 0 {
+			fail--
+			// Send one and fail
+			sent = append(sent, es[0].Domain)
+			return 1, errors.New("foo")
+		}
+
+		for _, e := range es {
+			sent = append(sent, e.Domain)
+		}
+
+		if len(sent) == 5 {
+			close(done)
+		}
+
+		return len(es), nil
+	}
+
+	q := newPeerQueue("foo", send, 10, 2, 0, time.Millisecond, 2*time.Millisecond)
+	defer q.close()
+
+	// Hold the queue to fill it before the sending starts
+	mtx.Lock()
+	for _, d := range []string{"a", "b", "c", "d", "e"} {
+		q.push(&cacheEntry{IP: net.ParseIP("1.2.3.4"), Domain: d})
+	}
+	mtx.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	mtx.Lock()
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, sent)
+	for _, b := range batches {
+		assert.LessOrEqual(t, b, 2)
+	}
+	mtx.Unlock()
+	assert.Equal(t, 0, q.len())
+}
+
+func Test_peerQueueDrop(t *testing.T) {
+	block := make(chan struct{})
+	send := func(es []*cacheEntry) (int, error) {
+		<-block
+		return len(es), nil
+	}
+
+	q := newPeerQueue("bar", send, 3, 1, 0, time.Millisecond, time.Millisecond)
+	defer q.close()
+	defer close(block)
+
+	for _, d := range []string{"a", "b", "c", "d", "e", "f"} {
+		q.push(&cacheEntry{Domain: d})
+	}
+
+	// One entry may be already taken by the sender, the rest are limited by the size
+	assert.Equal(t, 3, q.len())
+
+	q.Lock()
+	assert.Equal(t, "f", q.q[2].Domain)
+	q.Unlock()
+}
+
+func Test_peerQueueWindow(t *testing.T) {
+	sent := make(chan int, 10)
+	send := func(es []*cacheEntry) (int, error) {
+		sent <- len(es)
+		return len(es), nil
+	}
+
+	q := newPeerQueue("foo", send, 100, 5, 200*time.Millisecond, time.Millisecond, time.Millisecond)
+	defer q.close()
+
+	// The burst is sent together after the window
+	for i := 0; i < 3; i++ {
+		q.push(&cacheEntry{})
+	}
+
+	assert.Equal(t, 3, <-sent)
+
+	// Whole batch is sent without waiting
+	t0 := time.Now()
+	for i := 0; i < 5; i++ {
+		q.push(&cacheEntry{})
+	}
+
+	assert.Equal(t, 5, <-sent)
+	assert.Less(t, time.Since(t0), 200*time.Millisecond)
+}
@@ -1,50 +1,235 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"google.golang.org/grpc"
 )
 
 type syncerCfg struct {
 	Listen       string
 	SyncInterval string
 	Peers        []string
+
+	// Unique ID of the instance to track the entries' path when relaying, the hostname by default
+	ID string
+
+	// Push the entries received from the peers to the other peers
+	Relay bool
+
+	// How many instances an entry can pass through to be relayed further
+	MaxHops int
+
+	// How many last changes to keep for the peers' delta syncs
+	ChangeLogSize int
+
+	// Ask the peers to gzip the full sync stream
+	Compress bool
+
+	// Serve and connect to the peers over TLS
+	TLS *tlsCfg
+
+	// Shared secret to sign the requests with, the unsigned requests are rejected if it's set
+	Secret string
+
+	// Validation of the entries received from the peers
+	Inbound *inboundCfg
+
+	// How many entries to keep queued for each peer while pushing, the oldest ones are dropped
+	QueueSize int
+
+	// The most entries to push in one request
+	BatchSize int
+
+	// How long to wait for more entries to push them together
+	BatchWindow string
+
+	// Minimum and maximum delays between the retries of failed pushes, doubled after each failure
+	RetryMin string
+	RetryMax string
+
+	// How often the refreshes of an entry are propagated to the peers
+	RefreshInterval string
+
+	// Discover the peers using gossip
+	Gossip *gossipCfg
+
+	// Where to serve the gRPC sync, the peers prefixed with grpc:// are synced using it
+	GRPCListen string
+
+	// Follow the changes of the gRPC peers as they happen instead of only pulling them periodically
+	Watch bool
 }
 
-type getAllFunc func() []*cacheEntry
+// eachFunc calls fn with every cached entry until it returns false
+type eachFunc func(fn func(*cacheEntry) bool)
 type addFunc func(*cacheEntry, bool) bool
-type syncFunc func(string, int, error)
+type syncFunc func(peer string, new, rejected int, err error)
+
+// syncStateStore persists the sync progress with the peers and the change log they sync from
+type syncStateStore interface {
+	loadSyncStates() (map[string]*syncState, error)
+	saveSyncState(string, *syncState) error
+	changeStore
+}
+
+// changesResponse is a batch of the changes since the requested sequence number
+type changesResponse struct {
+	Epoch string
+	// The sequence number of the last entry in the batch
+	Seq uint64
+	// The history was truncated and a full sync is needed
+	Truncated bool
+	// There are more changes after this batch
+	More    bool
+	Entries []*cacheEntry
+}
+
+const (
+	changesBatch = 10000
+
+	contentTypeNDJSON = "application/x-ndjson"
+
+	headerEpoch = "X-Sync-Epoch"
+	headerSeq   = "X-Sync-Seq"
+
+	headerBatch     = "X-Sync-Batch"
+	headerTimestamp = "X-Sync-Timestamp"
+	headerSignature = "X-Sync-Signature"
+
+	// How far the signed request's timestamp can be off to limit the replays
+	signatureSkew = 5 * time.Minute
+
+	// The signed requests are read whole to check the signature, so their size is limited
+	maxSignedBody = 64 << 20
+)
 
 type syncer struct {
-	s *http.Server
-	c *http.Client
+	s  *http.Server
+	gs *grpc.Server
+	c  *http.Client
+	// Client for the full syncs which can take long, so only the response headers have a timeout
+	sc       *http.Client
+	compress bool
+	scheme   string
+	secret   []byte
+	id       string
+	relay    bool
+	maxHops  int
 
-	syncInterval time.Duration
-	peers        []string
+	syncInterval    time.Duration
+	refreshInterval time.Duration
 
-	getAll getAllFunc
-	add    addFunc
-	syncCb syncFunc
+	// Push queues of the configured and discovered peers by address
+	peers    map[string]*peerQueue
+	static   map[string]bool
+	peersMtx sync.RWMutex
+	newQueue func(string) *peerQueue
+	gossip   *gossip
+	// The peers which accept the batch pushes
+	batch sync.Map
+
+	// Connections to the gRPC peers by address
+	conns    map[string]*grpc.ClientConn
+	connsMtx sync.Mutex
+	dialOpts []grpc.DialOption
+	watch    bool
+
+	retryMin time.Duration
+	retryMax time.Duration
+
+	each    eachFunc
+	add     addFunc
+	syncCb  syncFunc
+	inbound *inboundPolicy
+
+	changes   *changeLog
+	states    map[string]*syncState
+	statesMtx sync.Mutex
+	store     syncStateStore
+	syncMtx   sync.Mutex
 
 	shutdown chan struct{}
 }
 
-func newSyncer(cf *syncerCfg, getAll getAllFunc, add addFunc, syncCb syncFunc) (s *syncer, err error) {
+func newSyncer(cf *syncerCfg, each eachFunc, add addFunc, syncCb syncFunc, store syncStateStore, lists domainLists) (s *syncer, err error) {
 	s = &syncer{
-		getAll:       getAll,
-		add:          add,
-		peers:        cf.Peers,
-		syncCb:       syncCb,
-		shutdown:     make(chan struct{}),
-		syncInterval: 10 * time.Minute,
+		each:            each,
+		add:             add,
+		peers:           map[string]*peerQueue{},
+		static:          map[string]bool{},
+		conns:           map[string]*grpc.ClientConn{},
+		syncCb:          syncCb,
+		store:           store,
+		states:          map[string]*syncState{},
+		shutdown:        make(chan struct{}),
+		syncInterval:    10 * time.Minute,
+		refreshInterval: time.Minute,
+		compress:        cf.Compress,
+		scheme:          "http",
+		secret:          []byte(cf.Secret),
+		id:              cf.ID,
+		relay:           cf.Relay,
+		maxHops:         cf.MaxHops,
+		watch:           cf.Watch,
+	}
+
+	if s.id == "" {
+		if s.id, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("unable to get hostname: %w", err)
+		}
+	}
+
+	if s.maxHops < 0 {
+		return nil, fmt.Errorf("maxHops should be positive")
+	} else if s.maxHops == 0 {
+		s.maxHops = 8
+	}
+
+	if cf.ChangeLogSize < 0 {
+		return nil, fmt.Errorf("changeLogSize should be positive")
+	} else if cf.ChangeLogSize == 0 {
+		cf.ChangeLogSize = 100000
+	}
+
+	var cs changeStore
+	if store != nil {
+		cs = store
+	}
+
+	if s.changes, err = newChangeLog(cf.ChangeLogSize, cs); err != nil {
+		return nil, err
+	}
+
+	if s.inbound, err = newInboundPolicy(cf.Inbound, lists); err != nil {
+		return nil, err
+	}
+
+	if store != nil {
+		if s.states, err = store.loadSyncStates(); err != nil {
+			return nil, fmt.Errorf("unable to load sync states: %w", err)
+		}
 	}
 
 	if cf.SyncInterval != "" {
@@ -53,9 +238,111 @@ func newSyncer(cf *syncerCfg, getAll getAllFunc, add addFunc, syncCb syncFunc) (
 		}
 	}
 
-	if len(cf.Peers) > 0 {
-		s.c = &http.Client{
-			Timeout: 5 * time.Second,
+	var stc, ctc *tls.Config
+	if cf.TLS != nil {
+		s.scheme = "https"
+
+		if ctc, err = cf.TLS.clientConfig(); err != nil {
+			return nil, err
+		}
+
+		if cf.Listen != "" || cf.GRPCListen != "" {
+			if stc, err = cf.TLS.serverConfig(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if cf.RefreshInterval != "" {
+		if s.refreshInterval, err = time.ParseDuration(cf.RefreshInterval); err != nil {
+			return nil, fmt.Errorf("unable to parse refreshInterval: %w", err)
+		}
+	}
+
+	if cf.QueueSize < 0 || cf.BatchSize < 0 {
+		return nil, fmt.Errorf("queueSize and batchSize should be positive")
+	}
+
+	if cf.QueueSize == 0 {
+		cf.QueueSize = 10000
+	}
+
+	if cf.BatchSize == 0 {
+		cf.BatchSize = 1000
+	}
+
+	batchWindow := 100 * time.Millisecond
+	if cf.BatchWindow != "" {
+		if batchWindow, err = time.ParseDuration(cf.BatchWindow); err != nil {
+			return nil, fmt.Errorf("unable to parse batchWindow: %w", err)
+		}
+	}
+
+	s.retryMin, s.retryMax = time.Second, time.Minute
+	if cf.RetryMin != "" {
+		if s.retryMin, err = time.ParseDuration(cf.RetryMin); err != nil {
+			return nil, fmt.Errorf("unable to parse retryMin: %w", err)
+		}
+	}
+
+	if cf.RetryMax != "" {
+		if s.retryMax, err = time.ParseDuration(cf.RetryMax); err != nil {
+			return nil, fmt.Errorf("unable to parse retryMax: %w", err)
+		}
+	}
+
+	if s.retryMin <= 0 || s.retryMax < s.retryMin {
+		return nil, fmt.Errorf("retryMin should be positive and not greater than retryMax")
+	}
+
+	s.c = &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: ctc,
+		},
+	}
+
+	s.sc = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:       ctc,
+			ResponseHeaderTimeout: 5 * time.Second,
+			DisableCompression:    true,
+		},
+	}
+
+	s.newQueue = func(p string) *peerQueue {
+		send := func(es []*cacheEntry) (int, error) {
+			return s.sendBatch(es, p)
+		}
+
+		return newPeerQueue(p, send, cf.QueueSize, cf.BatchSize, batchWindow, s.retryMin, s.retryMax)
+	}
+
+	// The gRPC calls are signed without the streamed entries, so only TLS protects them from being replayed
+	if len(s.secret) > 0 && cf.TLS == nil {
+		grpcUsed := cf.GRPCListen != ""
+		for _, p := range cf.Peers {
+			grpcUsed = grpcUsed || isGRPC(p)
+		}
+
+		if grpcUsed {
+			return nil, fmt.Errorf("you need to configure TLS to use gRPC sync with a secret")
+		}
+	}
+
+	if err = s.initGRPC(cf.GRPCListen, stc, ctc); err != nil {
+		return nil, err
+	}
+
+	for _, p := range cf.Peers {
+		s.static[p] = true
+		s.addPeer(p)
+	}
+
+	if cf.Gossip != nil {
+		_, port, _ := net.SplitHostPort(cf.Listen)
+		if s.gossip, err = newGossip(cf.Gossip, port, s.memberCb); err != nil {
+			return nil, err
 		}
 	}
 
@@ -63,6 +350,14 @@ func newSyncer(cf *syncerCfg, getAll getAllFunc, add addFunc, syncCb syncFunc) (
 		go s.syncScheduler()
 	}
 
+	if s.watch {
+		for _, p := range cf.Peers {
+			if isGRPC(p) {
+				go s.watchPeer(p)
+			}
+		}
+	}
+
 	if cf.Listen == "" {
 		return
 	}
@@ -77,13 +372,25 @@ func newSyncer(cf *syncerCfg, getAll getAllFunc, add addFunc, syncCb syncFunc) (
 		return nil, err
 	}
 
-	s.s = &http.Server{}
+	s.s = &http.Server{
+		TLSConfig: stc,
+		// Failed TLS handshakes, e.g. peers without a valid client certificate, are logged here
+		ErrorLog: log.New(log.Writer(), "Syncer: ", log.Flags()),
+	}
 
-	http.HandleFunc("/fetch", s.handleFetch)
-	http.HandleFunc("/put", s.handlePut)
+	http.HandleFunc("/fetch", s.auth(s.handleFetch))
+	http.HandleFunc("/changes", s.auth(s.handleChanges))
+	http.HandleFunc("/put", s.auth(s.handlePut))
 
 	go func() {
-		if err := s.s.Serve(l); err != nil && err != http.ErrServerClosed {
+		var err error
+		if stc != nil {
+			err = s.s.ServeTLS(l, "", "")
+		} else {
+			err = s.s.Serve(l)
+		}
+
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
@@ -91,61 +398,416 @@ func newSyncer(cf *syncerCfg, getAll getAllFunc, add addFunc, syncCb syncFunc) (
 	return
 }
 
+// sign returns the signature of the request's method, URI, timestamp and body
+func (s *syncer) sign(method, uri, ts string, body []byte) string {
+	m := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(m, "%s\n%s\n%s\n", method, uri, ts)
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func (s *syncer) verify(wr http.ResponseWriter, r *http.Request) (err error) {
+	if len(s.secret) == 0 {
+		return
+	}
+
+	// The body is read into memory only for the requests which could be genuine
+	ts, sig := r.Header.Get(headerTimestamp), r.Header.Get(headerSignature)
+	if err = checkTimestamp(ts, sig); err != nil {
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(wr, r.Body, maxSignedBody))
+	if err != nil {
+		return fmt.Errorf("unable to read body: %w", err)
+	}
+
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	return s.checkSignature(r.Method, r.URL.RequestURI(), ts, sig, body)
+}
+
+// checkTimestamp checks that the request is signed and its timestamp is within the allowed skew
+func checkTimestamp(ts, sig string) error {
+	if sig == "" || ts == "" {
+		return errors.New("request is not signed")
+	}
+
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("unable to parse timestamp: %w", err)
+	}
+
+	if d := time.Since(time.Unix(t, 0)); d > signatureSkew || d < -signatureSkew {
+		return fmt.Errorf("timestamp is off by %s", d.Round(time.Second))
+	}
+
+	return nil
+}
+
+func (s *syncer) checkSignature(method, uri, ts, sig string, body []byte) error {
+	if err := checkTimestamp(ts, sig); err != nil {
+		return err
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(s.sign(method, uri, ts, body))) {
+		return errors.New("signature mismatch")
+	}
+
+	return nil
+}
+
+// auth rejects the requests not signed with the shared secret
+func (s *syncer) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(wr http.ResponseWriter, r *http.Request) {
+		if err := s.verify(wr, r); err != nil {
+			log.Printf("Syncer: rejected unauthenticated request to %s from %s: %s", r.URL.Path, r.RemoteAddr, err)
+
+			var mbe *http.MaxBytesError
+			if errors.As(err, &mbe) {
+				wr.WriteHeader(413)
+			} else {
+				wr.WriteHeader(401)
+			}
+
+			return
+		}
+
+		// Let the peers know they can push in batches
+		wr.Header().Set(headerBatch, "true")
+		h(wr, r)
+	}
+}
+
 func (s *syncer) handleFetch(wr http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		wr.WriteHeader(400)
 		return
 	}
 
-	json.NewEncoder(wr).Encode(s.getAll())
+	// The entries added while the snapshot is taken will be also sent in the next delta
+	st := s.changes.state()
+	wr.Header().Set(headerEpoch, st.Epoch)
+	wr.Header().Set(headerSeq, strconv.FormatUint(st.Seq, 10))
+
+	// The older peers get a JSON array, it's also written as the cache is iterated
+	if r.FormValue("format") != "ndjson" {
+		io.WriteString(wr, "[")
+
+		first := true
+		s.each(func(e *cacheEntry) bool {
+			if !first {
+				if _, err := io.WriteString(wr, ","); err != nil {
+					return false
+				}
+			}
+
+			first = false
+			js, _ := json.Marshal(e)
+			_, err := wr.Write(js)
+			return err == nil
+		})
+
+		io.WriteString(wr, "]\n")
+		return
+	}
+
+	// Stream the entries one per line so that neither side has to hold the whole encoded cache
+	var w io.Writer = wr
+	wr.Header().Set("Content-Type", contentTypeNDJSON)
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		wr.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(wr)
+		defer gz.Close()
+		w = gz
+	}
+
+	enc := json.NewEncoder(w)
+	s.each(func(e *cacheEntry) bool {
+		return enc.Encode(e) == nil
+	})
 }
 
-func (s *syncer) handlePut(wr http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
+func (s *syncer) handleChanges(wr http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		wr.WriteHeader(400)
+		return
+	}
 
-	c := &cacheEntry{}
-	if err := json.NewDecoder(r.Body).Decode(c); err != nil && err != io.EOF {
+	seq, err := strconv.ParseUint(r.FormValue("since"), 10, 64)
+	if err != nil {
 		wr.WriteHeader(400)
 		fmt.Fprintf(wr, "Bad request: %s", err)
 		return
 	}
 
-	s.add(c, false)
+	es, last, ok := s.changes.since(r.FormValue("epoch"), seq, changesBatch)
+	resp := &changesResponse{
+		Epoch:     s.changes.state().Epoch,
+		Seq:       last,
+		Truncated: !ok,
+		More:      ok && len(es) == changesBatch,
+		Entries:   es,
+	}
+
+	json.NewEncoder(wr).Encode(resp)
 }
 
-func (s *syncer) broadcast(e *cacheEntry) (err error) {
-	if s.c == nil {
+// record adds the entry to the change log for the peers' delta syncs
+func (s *syncer) record(e *cacheEntry) {
+	s.changes.add(e)
+}
+
+// decodeEntries reads a single entry, a JSON array or a stream of entries and passes them to fn
+func decodeEntries(r io.Reader, fn func(*cacheEntry)) (err error) {
+	br := bufio.NewReader(r)
+
+	var b byte
+	for {
+		if b, err = br.ReadByte(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return
+		}
+
+		if !strings.ContainsRune(" \t\r\n", rune(b)) {
+			br.UnreadByte()
+			break
+		}
+	}
+
+	dec := json.NewDecoder(br)
+	if b == '[' {
+		// Skip the opening bracket and read the elements one by one
+		if _, err = dec.Token(); err != nil {
+			return
+		}
+
+		for dec.More() {
+			e := &cacheEntry{}
+			if err = dec.Decode(e); err != nil {
+				return
+			}
+
+			fn(e)
+		}
+
+		_, err = dec.Token()
 		return
 	}
 
-	for _, p := range s.peers {
-		if err = s.send(e, p); err != nil {
+	for {
+		e := &cacheEntry{}
+		if err = dec.Decode(e); err == io.EOF {
+			return nil
+		} else if err != nil {
 			return
 		}
+
+		fn(e)
+	}
+}
+
+func (s *syncer) handlePut(wr http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	var new, rejected int
+	err := decodeEntries(r.Body, func(c *cacheEntry) {
+		applied, rej := s.receive(host, c)
+		if applied {
+			new++
+		} else if rej {
+			rejected++
+		}
+	})
+
+	s.pushed(host, new, rejected)
+
+	if err != nil {
+		wr.WriteHeader(400)
+		fmt.Fprintf(wr, "Bad request: %s", err)
+	}
+}
+
+// receive applies the entry pushed by the peer, returns whether it has changed the cache
+// and whether it was rejected by the inbound policy
+func (s *syncer) receive(peer string, c *cacheEntry) (applied, rejected bool) {
+	c.Source = "peer " + peer
+
+	// Came back through the other peers
+	if s.looped(c) {
+		mSyncerRejected.WithLabelValues(peer, "loop").Inc()
+		return false, false
+	}
+
+	if s.accept(peer, c) != "" {
+		return false, true
+	}
+
+	if !s.add(c, false) {
+		return false, false
+	}
+
+	s.relayEntry(c)
+	return true, false
+}
+
+// pushed reports the push received from the peer if some of its entries were rejected,
+// the reasons are counted in the metrics
+func (s *syncer) pushed(peer string, new, rejected int) {
+	if rejected > 0 && s.syncCb != nil {
+		s.syncCb(peer, new, rejected, nil)
+	}
+}
+
+// accept checks the entry against the inbound policy and returns the reason if it's rejected
+func (s *syncer) accept(peer string, e *cacheEntry) (reason string) {
+	if reason = s.inbound.check(e); reason != "" {
+		mSyncerRejected.WithLabelValues(peer, reason).Inc()
 	}
 
 	return
 }
 
-func (s *syncer) callPeer(p, handler, method string, body io.ReadCloser) (resp *http.Response, err error) {
-	u, _ := url.Parse(fmt.Sprintf("http://%s/%s", p, handler))
+// looped returns true if the entry originated from or already passed through this instance.
+// It's checked only when relaying: otherwise the entries aren't forwarded and can't loop,
+// while the instances sharing the ID (e.g. the default hostname) would reject each other's ones.
+func (s *syncer) looped(e *cacheEntry) bool {
+	if !s.relay {
+		return false
+	}
+
+	if e.Origin == s.id {
+		return true
+	}
+
+	for _, h := range e.Hops {
+		if h == s.id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// relayEntry pushes the entry received from a peer further if it's enabled and the hops limit allows
+func (s *syncer) relayEntry(e *cacheEntry) {
+	if s.relay && len(e.Hops) < s.maxHops {
+		s.broadcast(e)
+	}
+}
+
+// broadcast queues the entry to be pushed to all peers with this instance added to its path
+func (s *syncer) broadcast(e *cacheEntry) {
+	cp := *e
+	if cp.Origin == "" {
+		cp.Origin = s.id
+	}
+
+	cp.Hops = append(cp.Hops[:len(cp.Hops):len(cp.Hops)], s.id)
+
+	s.peersMtx.RLock()
+	defer s.peersMtx.RUnlock()
+
+	for _, q := range s.peers {
+		q.push(&cp)
+	}
+}
+
+func (s *syncer) addPeer(p string) {
+	s.peersMtx.Lock()
+	defer s.peersMtx.Unlock()
+
+	if _, ok := s.peers[p]; !ok {
+		s.peers[p] = s.newQueue(p)
+	}
+}
+
+// removePeer stops pushing to the peer, the configured ones are never removed
+func (s *syncer) removePeer(p string) {
+	s.peersMtx.Lock()
+	defer s.peersMtx.Unlock()
+
+	if q, ok := s.peers[p]; ok && !s.static[p] {
+		q.close()
+		delete(s.peers, p)
+	}
+}
+
+func (s *syncer) peerList() (ps []string) {
+	s.peersMtx.RLock()
+	defer s.peersMtx.RUnlock()
+
+	for p := range s.peers {
+		ps = append(ps, p)
+	}
+
+	sort.Strings(ps)
+	return
+}
+
+// memberCb follows the peers discovered by the gossip
+func (s *syncer) memberCb(addr string, alive bool) {
+	log.Printf("Syncer: peer %s is alive: %t", addr, alive)
+
+	if alive {
+		s.addPeer(addr)
+	} else {
+		s.removePeer(addr)
+	}
+}
+
+func (s *syncer) newRequest(p, handler, method string, body []byte) *http.Request {
+	u, _ := url.Parse(fmt.Sprintf("%s://%s/%s", s.scheme, p, handler))
+	return s.newURLRequest(u, method, body)
+}
+
+// newURLRequest returns the request to the URL signed with the shared secret if it's set
+func (s *syncer) newURLRequest(u *url.URL, method string, body []byte) *http.Request {
 	r := &http.Request{
 		Method: method,
 		URL:    u,
-		Body:   body,
+		Header: http.Header{},
+	}
+
+	if body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
 	}
 
-	if resp, err = s.c.Do(r); err != nil {
+	if len(s.secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		r.Header.Set(headerTimestamp, ts)
+		r.Header.Set(headerSignature, s.sign(method, u.RequestURI(), ts, body))
+	}
+
+	return r
+}
+
+func (s *syncer) do(c *http.Client, r *http.Request) (resp *http.Response, err error) {
+	if resp, err = c.Do(r); err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
 		return nil, fmt.Errorf("HTTP Code not 200: %d", resp.StatusCode)
 	}
 
+	if resp.Header.Get(headerBatch) != "" {
+		s.batch.Store(r.URL.Host, true)
+	}
+
 	return
 }
 
+func (s *syncer) callPeer(p, handler, method string, body []byte) (resp *http.Response, err error) {
+	return s.do(s.c, s.newRequest(p, handler, method, body))
+}
+
 func (s *syncer) syncScheduler() {
 	t := time.NewTicker(s.syncInterval)
 
@@ -161,45 +823,168 @@ func (s *syncer) syncScheduler() {
 }
 
 func (s *syncer) syncAll() {
-	for _, p := range s.peers {
-		new := 0
+	s.syncMtx.Lock()
+	defer s.syncMtx.Unlock()
 
-		es, err := s.fetchRemote(p)
+	for _, p := range s.peerList() {
+		total, new, rejected, full, err := s.syncPeer(p)
 		if err != nil {
-			s.syncCb(p, 0, err)
+			s.syncCb(p, 0, rejected, err)
 			continue
 		}
 
-		for _, e := range es {
-			if s.add(e, false) {
-				new++
-			}
+		log.Printf("Syncer: got %d (%d new, %d rejected) entries from peer %s (full: %t)", total, new, rejected, p, full)
+		s.syncCb(p, new, rejected, nil)
+	}
+}
+
+// syncPeer fetches the changes since the last sync or the whole cache
+// if it's the first sync or the peer's history doesn't go back that far
+func (s *syncer) syncPeer(p string) (total, new, rejected int, full bool, err error) {
+	add := func(e *cacheEntry) {
+		total++
+		e.Source = "peer " + p
+
+		if s.accept(p, e) != "" {
+			rejected++
+			return
 		}
 
-		log.Printf("Syncer: got %d (%d new) entries from peer %s", len(es), new, p)
+		if s.add(e, false) {
+			s.relayEntry(e)
+			new++
+		}
+	}
+
+	if isGRPC(p) {
+		full, err = s.pullGRPC(p, add)
+		return
+	}
+
+	st := s.state(p)
+	for st != nil {
+		resp, err := s.fetchChanges(p, st)
+		if err != nil {
+			log.Printf("Syncer: unable to fetch changes from peer %s, doing full sync: %s", p, err)
+			break
+		}
+
+		if resp.Truncated {
+			break
+		}
+
+		for _, e := range resp.Entries {
+			add(e)
+		}
+
+		st = &syncState{Epoch: resp.Epoch, Seq: resp.Seq}
+		s.saveState(p, st)
+
+		if !resp.More {
+			return total, new, rejected, false, nil
+		}
+	}
+
+	if st, err = s.fetchRemote(p, add); err != nil {
+		return
+	}
+
+	if st != nil {
+		s.saveState(p, st)
+	}
+
+	return total, new, rejected, true, nil
+}
+
+func (s *syncer) state(p string) *syncState {
+	s.statesMtx.Lock()
+	defer s.statesMtx.Unlock()
+	return s.states[p]
+}
 
-		s.syncCb(p, new, nil)
+func (s *syncer) saveState(p string, st *syncState) {
+	s.statesMtx.Lock()
+	s.states[p] = st
+	s.statesMtx.Unlock()
+
+	if s.store == nil {
+		return
+	}
+
+	if err := s.store.saveSyncState(p, st); err != nil {
+		log.Printf("Syncer: unable to save sync state of peer %s: %s", p, err)
 	}
 }
 
-func (s *syncer) fetchRemote(p string) (es []*cacheEntry, err error) {
-	resp, err := s.callPeer(p, "fetch", "GET", nil)
+func (s *syncer) fetchChanges(p string, st *syncState) (cr *changesResponse, err error) {
+	defer func() {
+		mSyncerRequests.WithLabelValues(p, "changes", resultLabel(err)).Inc()
+	}()
+
+	q := url.Values{}
+	q.Set("epoch", st.Epoch)
+	q.Set("since", strconv.FormatUint(st.Seq, 10))
+
+	resp, err := s.callPeer(p, "changes?"+q.Encode(), "GET", nil)
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
 
-	if err = json.NewDecoder(resp.Body).Decode(&es); err != nil {
+	cr = &changesResponse{}
+	err = json.NewDecoder(resp.Body).Decode(cr)
+	return
+}
+
+// fetchRemote streams the whole cache of the peer into fn and returns the sync state it corresponds to,
+// which is nil for the peers not supporting delta syncs. The peers not supporting streaming reply with a JSON array.
+func (s *syncer) fetchRemote(p string, fn func(*cacheEntry)) (st *syncState, err error) {
+	defer func() {
+		mSyncerRequests.WithLabelValues(p, "fetch", resultLabel(err)).Inc()
+	}()
+
+	r := s.newRequest(p, "fetch?format=ndjson", "GET", nil)
+	if s.compress {
+		r.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	resp, err := s.do(s.sc, r)
+	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	if err = decodeEntries(body, fn); err != nil {
+		return
+	}
+
+	if epoch := resp.Header.Get(headerEpoch); epoch != "" {
+		seq, err := strconv.ParseUint(resp.Header.Get(headerSeq), 10, 64)
+		if err == nil {
+			st = &syncState{Epoch: epoch, Seq: seq}
+		}
+	}
 
 	return
 }
 
 func (s *syncer) send(e *cacheEntry, p string) (err error) {
+	defer func() {
+		mSyncerRequests.WithLabelValues(p, "push", resultLabel(err)).Inc()
+	}()
+
 	js, _ := json.Marshal(e)
-	b := bytes.NewReader(js)
-	resp, err := s.callPeer(p, "put", "PUT", io.NopCloser(b))
+	resp, err := s.callPeer(p, "put", "PUT", js)
 	if err != nil {
 		return
 	}
@@ -208,9 +993,79 @@ func (s *syncer) send(e *cacheEntry, p string) (err error) {
 	return
 }
 
+// sendBatch pushes the entries in one request if the peer supports it, otherwise one by one.
+// Returns how many were sent before an error.
+func (s *syncer) sendBatch(es []*cacheEntry, p string) (n int, err error) {
+	if isGRPC(p) {
+		return s.pushGRPC(es, p)
+	}
+
+	if _, ok := s.batch.Load(p); !ok {
+		for _, e := range es {
+			if err = s.send(e, p); err != nil {
+				return
+			}
+
+			n++
+		}
+
+		return
+	}
+
+	defer func() {
+		mSyncerRequests.WithLabelValues(p, "push", resultLabel(err)).Inc()
+	}()
+
+	b := &bytes.Buffer{}
+	enc := json.NewEncoder(b)
+	for _, e := range es {
+		enc.Encode(e)
+	}
+
+	r := s.newRequest(p, "put", "PUT", b.Bytes())
+	r.Header.Set("Content-Type", contentTypeNDJSON)
+
+	resp, err := s.do(s.c, r)
+	if err != nil {
+		return
+	}
+
+	resp.Body.Close()
+	return len(es), nil
+}
+
 func (s *syncer) close() error {
 	close(s.shutdown)
 
+	if s.gossip != nil {
+		if err := s.gossip.close(); err != nil {
+			log.Printf("Syncer: unable to stop gossip: %s", err)
+		}
+	}
+
+	s.peersMtx.Lock()
+	for _, q := range s.peers {
+		q.close()
+	}
+	s.peersMtx.Unlock()
+
+	s.connsMtx.Lock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.connsMtx.Unlock()
+
+	// The watchers are stopped by the shutdown, so it doesn't wait for them
+	if s.gs != nil {
+		s.gs.GracefulStop()
+	}
+
+	s.changes.close()
+
+	if s.s == nil {
+		return nil
+	}
+
 	c, f := context.WithTimeout(context.Background(), 5*time.Second)
 	defer f()
 
@@ -1,15 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// eachOf iterates over the entries like the cache does
+func eachOf(es []*cacheEntry) eachFunc {
+	return func(fn func(*cacheEntry) bool) {
+		for _, e := range es {
+			if !fn(e) {
+				return
+			}
+		}
+	}
+}
+
 func Test_syncer(t *testing.T) {
 	e0 := &cacheEntry{
 		IP:     net.ParseIP("1.2.3.4"),
@@ -17,25 +35,34 @@ func Test_syncer(t *testing.T) {
 		TS:     time.Now(),
 	}
 
-	ga := func() []*cacheEntry {
-		return []*cacheEntry{
-			e0,
-		}
-	}
+	ga := eachOf([]*cacheEntry{e0})
 
+	var mtx sync.Mutex
 	var e1 *cacheEntry
+	var added []*cacheEntry
 	ch := make(chan struct{})
 	add := func(e *cacheEntry, b bool) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+
 		e1 = e
-		close(ch)
+		added = append(added, e)
+		if ch != nil {
+			close(ch)
+			ch = nil
+		}
 		return false
 	}
 
 	var err2 error
-	cb := func(s string, i int, err error) {
-		if err != nil {
+	cb := func(s string, i, r int, err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		if err != nil && ch != nil {
 			err2 = err
 			close(ch)
+			ch = nil
 		}
 	}
 
@@ -43,7 +70,7 @@ func Test_syncer(t *testing.T) {
 	s, err := newSyncer(&syncerCfg{
 		Listen: fmt.Sprintf("0.0.0.0:%d", port),
 		Peers:  []string{fmt.Sprintf("127.0.0.1:%d", port)},
-	}, ga, add, cb)
+	}, ga, add, cb, nil, nil)
 	assert.Nil(t, err)
 
 	e2 := &cacheEntry{
@@ -52,19 +79,321 @@ func Test_syncer(t *testing.T) {
 		TS:     time.Now(),
 	}
 
+	mtx.Lock()
+	done := ch
+	mtx.Unlock()
+
 	s.broadcast(e2)
-	<-ch
+	<-done
+
+	mtx.Lock()
 	assert.Equal(t, e2.IP, e1.IP)
 	assert.Equal(t, e2.Domain, e1.Domain)
-
 	ch = make(chan struct{})
+	done = ch
+	mtx.Unlock()
+
 	s.syncAll()
-	<-ch
+	<-done
 
+	mtx.Lock()
 	assert.Equal(t, e0.IP, e1.IP)
 	assert.Equal(t, e0.Domain, e1.Domain)
 	assert.Nil(t, err2)
+	mtx.Unlock()
+
+	// The full sync has saved the position, only the new changes are fetched now
+	p := fmt.Sprintf("127.0.0.1:%d", port)
+	assert.Equal(t, s.changes.state(), s.states[p])
+
+	s.record(e2)
+	added = nil
+	s.syncAll()
+	assert.Len(t, added, 1)
+	assert.Equal(t, e2.Domain, added[0].Domain)
+
+	added = nil
+	s.syncAll()
+	assert.Len(t, added, 0)
+
+	// Unknown epoch - full sync
+	s.states[p] = &syncState{Epoch: "foo", Seq: 1}
+	s.syncAll()
+	assert.Len(t, added, 1)
+	assert.Equal(t, e0.Domain, added[0].Domain)
+	assert.Equal(t, s.changes.state(), s.states[p])
 
 	err = s.close()
 	assert.Nil(t, err)
 }
+
+func Test_syncerFetchStream(t *testing.T) {
+	es := []*cacheEntry{
+		{IP: net.ParseIP("1.2.3.4"), Domain: "foo.bar", TS: time.Now()},
+		{IP: net.ParseIP("4.3.2.1"), Domain: "bar.foo", TS: time.Now()},
+	}
+
+	ga := eachOf(es)
+
+	s, err := newSyncer(&syncerCfg{
+		SyncInterval: "0s",
+		Peers:        []string{"127.0.0.1:1"},
+	}, ga, nil, nil, nil, nil)
+	assert.Nil(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(s.handleFetch))
+	defer srv.Close()
+	p := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, compress := range []bool{false, true} {
+		s.compress = compress
+
+		got := []*cacheEntry{}
+		st, err := s.fetchRemote(p, func(e *cacheEntry) {
+			got = append(got, e)
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, s.changes.state(), st)
+		assert.Len(t, got, 2)
+		assert.Equal(t, "bar.foo", got[1].Domain)
+	}
+
+	// Legacy JSON array
+	rec := httptest.NewRecorder()
+	s.handleFetch(rec, httptest.NewRequest("GET", "/fetch", nil))
+	got := []*cacheEntry{}
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.Len(t, got, 2)
+
+	rec = httptest.NewRecorder()
+	s.handleFetch(rec, httptest.NewRequest("GET", "/fetch?format=ndjson", nil))
+	assert.Equal(t, contentTypeNDJSON, rec.Header().Get("Content-Type"))
+	assert.Equal(t, 2, strings.Count(rec.Body.String(), "\n"))
+
+	s.each = eachOf(nil)
+	rec = httptest.NewRecorder()
+	s.handleFetch(rec, httptest.NewRequest("GET", "/fetch", nil))
+	assert.Equal(t, "[]\n", rec.Body.String())
+}
+
+func Test_syncerAuth(t *testing.T) {
+	s, err := newSyncer(&syncerCfg{
+		SyncInterval: "0s",
+		Secret:       "foo",
+	}, nil, nil, nil, nil, nil)
+	assert.Nil(t, err)
+
+	var body string
+	h := s.auth(func(wr http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+	})
+
+	serve := func(r *http.Request) int {
+		rec := httptest.NewRecorder()
+		h(rec, r)
+		return rec.Code
+	}
+
+	// newRequest produces client requests, convert them to the server ones
+	signed := func(body []byte) *http.Request {
+		r := s.newRequest("127.0.0.1:1", "put?a=b", "PUT", body)
+		sr := httptest.NewRequest(r.Method, r.URL.RequestURI(), bytes.NewReader(body))
+		sr.Header = r.Header
+		return sr
+	}
+
+	assert.Equal(t, 200, serve(signed([]byte("bar"))))
+	assert.Equal(t, "bar", body)
+
+	// The body of the unsigned requests isn't read
+	br := strings.NewReader("bar")
+	assert.Equal(t, 401, serve(httptest.NewRequest("PUT", "/put?a=b", br)))
+	assert.Equal(t, 3, br.Len())
+
+	r := signed([]byte("bar"))
+	r.Body = io.NopCloser(strings.NewReader("baz"))
+	assert.Equal(t, 401, serve(r))
+
+	r = signed([]byte("bar"))
+	r.URL.RawQuery = "a=c"
+	assert.Equal(t, 401, serve(r))
+
+	r = signed([]byte("bar"))
+	r.Header.Set(headerTimestamp, "1")
+	assert.Equal(t, 401, serve(r))
+
+	// Different secret
+	r = signed(nil)
+	s.secret = []byte("bar")
+	assert.Equal(t, 401, serve(r))
+	assert.Equal(t, "bar", body)
+}
+
+func Test_syncerInbound(t *testing.T) {
+	added := 0
+	add := func(e *cacheEntry, b bool) bool {
+		added++
+		return true
+	}
+
+	type report struct {
+		peer          string
+		new, rejected int
+	}
+
+	reports := []report{}
+	cb := func(p string, n, r int, err error) {
+		reports = append(reports, report{p, n, r})
+	}
+
+	s, err := newSyncer(&syncerCfg{
+		SyncInterval: "0s",
+		Inbound:      &inboundCfg{Deny: []string{"10.0.0.0/8"}},
+	}, nil, add, cb, nil, nil)
+	assert.Nil(t, err)
+
+	put := func(ips ...string) {
+		b := &bytes.Buffer{}
+		for _, ip := range ips {
+			json.NewEncoder(b).Encode(&cacheEntry{IP: net.ParseIP(ip), Domain: "foo.bar", TS: time.Now()})
+		}
+
+		s.handlePut(httptest.NewRecorder(), httptest.NewRequest("PUT", "/put", b))
+	}
+
+	put("10.1.1.1")
+	assert.Equal(t, 0, added)
+	put("1.2.3.4")
+	assert.Equal(t, 1, added)
+
+	// The rejections are reported once per push
+	put("10.1.1.1", "10.1.1.2", "4.3.2.1")
+	assert.Equal(t, 2, added)
+	assert.Equal(t, []report{{"192.0.2.1", 0, 1}, {"192.0.2.1", 1, 2}}, reports)
+}
+
+func Test_decodeEntries(t *testing.T) {
+	count := func(s string) (n int, err error) {
+		err = decodeEntries(strings.NewReader(s), func(e *cacheEntry) {
+			n++
+		})
+		return
+	}
+
+	for s, n := range map[string]int{
+		``:                     0,
+		" \n":                  0,
+		`{"Domain":"foo.bar"}`: 1,
+		` [{"Domain":"foo.bar"}, {"Domain":"bar.foo"}]`: 2,
+		"[]": 0,
+		"{\"Domain\":\"foo.bar\"}\n{\"Domain\":\"bar.foo\"}\n{}\n": 3,
+	} {
+		c, err := count(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, n, c, s)
+	}
+
+	_, err := count(`[{"Domain":"foo.bar"}`)
+	assert.NotNil(t, err)
+	_, err = count(`{"Domain":`)
+	assert.NotNil(t, err)
+}
+
+func Test_syncerBatch(t *testing.T) {
+	added := []*cacheEntry{}
+	add := func(e *cacheEntry, b bool) bool {
+		added = append(added, e)
+		return true
+	}
+
+	s, err := newSyncer(&syncerCfg{SyncInterval: "0s"}, nil, add, nil, nil, nil)
+	assert.Nil(t, err)
+
+	requests := 0
+	h := s.auth(s.handlePut)
+	srv := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		requests++
+		h(wr, r)
+	}))
+	defer srv.Close()
+	p := strings.TrimPrefix(srv.URL, "http://")
+
+	es := []*cacheEntry{
+		{IP: net.ParseIP("1.2.3.4"), Domain: "foo.bar"},
+		{IP: net.ParseIP("4.3.2.1"), Domain: "bar.foo"},
+		{IP: net.ParseIP("1.1.1.1"), Domain: "foo.foo"},
+	}
+
+	// It's unknown if the peer supports batches, so the entries are sent one by one
+	n, err := s.sendBatch(es, p)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, 3, requests)
+
+	n, err = s.sendBatch(es, p)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, 4, requests)
+
+	assert.Len(t, added, 6)
+	assert.Equal(t, "foo.foo", added[5].Domain)
+	assert.Equal(t, "peer 127.0.0.1", added[5].Source)
+}
+
+func Test_syncerRelay(t *testing.T) {
+	added := 0
+	add := func(e *cacheEntry, b bool) bool {
+		added++
+		return true
+	}
+
+	s, err := newSyncer(&syncerCfg{
+		SyncInterval: "0s",
+		ID:           "hub",
+		Relay:        true,
+		MaxHops:      2,
+		BatchWindow:  "1h",
+		Peers:        []string{"127.0.0.1:1"},
+	}, nil, add, nil, nil, nil)
+	assert.Nil(t, err)
+	defer s.close()
+
+	q := s.peers["127.0.0.1:1"]
+	put := func(e *cacheEntry) {
+		js, _ := json.Marshal(e)
+		s.handlePut(httptest.NewRecorder(), httptest.NewRequest("PUT", "/put", bytes.NewReader(js)))
+	}
+
+	// Relayed with the hub added to the path
+	put(&cacheEntry{IP: net.ParseIP("1.2.3.4"), Domain: "foo.bar", Origin: "a", Hops: []string{"a"}})
+	assert.Equal(t, 1, added)
+	assert.Equal(t, 1, q.len())
+	q.Lock()
+	assert.Equal(t, "a", q.q[0].Origin)
+	assert.Equal(t, []string{"a", "hub"}, q.q[0].Hops)
+	q.Unlock()
+
+	// Hops limit reached, added but not relayed
+	put(&cacheEntry{IP: net.ParseIP("1.2.3.4"), Domain: "foo.bar", Origin: "a", Hops: []string{"a", "b"}})
+	assert.Equal(t, 2, added)
+	assert.Equal(t, 1, q.len())
+
+	// Came back
+	put(&cacheEntry{IP: net.ParseIP("1.2.3.4"), Domain: "foo.bar", Origin: "a", Hops: []string{"a", "hub", "b"}})
+	put(&cacheEntry{IP: net.ParseIP("1.2.3.4"), Domain: "foo.bar", Origin: "hub", Hops: []string{"hub"}})
+	assert.Equal(t, 2, added)
+
+	// Local entries start the path
+	s.broadcast(&cacheEntry{IP: net.ParseIP("1.2.3.4"), Domain: "bar.foo"})
+	q.Lock()
+	assert.Equal(t, "hub", q.q[1].Origin)
+	assert.Equal(t, []string{"hub"}, q.q[1].Hops)
+	q.Unlock()
+
+	// Without relaying the path isn't checked, so the instances sharing the ID still sync
+	s.relay = false
+	put(&cacheEntry{IP: net.ParseIP("1.2.3.4"), Domain: "foo.bar", Origin: "hub", Hops: []string{"hub"}})
+	assert.Equal(t, 3, added)
+}
@@ -0,0 +1,277 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: sync.proto
+
+package syncpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Syncer_Push_FullMethodName  = "/dnstapbgp.sync.Syncer/Push"
+	Syncer_Pull_FullMethodName  = "/dnstapbgp.sync.Syncer/Pull"
+	Syncer_Watch_FullMethodName = "/dnstapbgp.sync.Syncer/Watch"
+)
+
+// SyncerClient is the client API for Syncer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SyncerClient interface {
+	// Push streams the entries to the peer
+	Push(ctx context.Context, opts ...grpc.CallOption) (Syncer_PushClient, error)
+	// Pull streams the changes since the given state or the whole cache
+	Pull(ctx context.Context, in *PullRequest, opts ...grpc.CallOption) (Syncer_PullClient, error)
+	// Watch is the same as Pull but then keeps streaming the changes as they happen
+	Watch(ctx context.Context, in *PullRequest, opts ...grpc.CallOption) (Syncer_WatchClient, error)
+}
+
+type syncerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSyncerClient(cc grpc.ClientConnInterface) SyncerClient {
+	return &syncerClient{cc}
+}
+
+func (c *syncerClient) Push(ctx context.Context, opts ...grpc.CallOption) (Syncer_PushClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Syncer_ServiceDesc.Streams[0], Syncer_Push_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &syncerPushClient{stream}
+	return x, nil
+}
+
+type Syncer_PushClient interface {
+	Send(*Batch) error
+	CloseAndRecv() (*PushResponse, error)
+	grpc.ClientStream
+}
+
+type syncerPushClient struct {
+	grpc.ClientStream
+}
+
+func (x *syncerPushClient) Send(m *Batch) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *syncerPushClient) CloseAndRecv() (*PushResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(PushResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *syncerClient) Pull(ctx context.Context, in *PullRequest, opts ...grpc.CallOption) (Syncer_PullClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Syncer_ServiceDesc.Streams[1], Syncer_Pull_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &syncerPullClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Syncer_PullClient interface {
+	Recv() (*PullResponse, error)
+	grpc.ClientStream
+}
+
+type syncerPullClient struct {
+	grpc.ClientStream
+}
+
+func (x *syncerPullClient) Recv() (*PullResponse, error) {
+	m := new(PullResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *syncerClient) Watch(ctx context.Context, in *PullRequest, opts ...grpc.CallOption) (Syncer_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Syncer_ServiceDesc.Streams[2], Syncer_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &syncerWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Syncer_WatchClient interface {
+	Recv() (*PullResponse, error)
+	grpc.ClientStream
+}
+
+type syncerWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *syncerWatchClient) Recv() (*PullResponse, error) {
+	m := new(PullResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SyncerServer is the server API for Syncer service.
+// All implementations must embed UnimplementedSyncerServer
+// for forward compatibility
+type SyncerServer interface {
+	// Push streams the entries to the peer
+	Push(Syncer_PushServer) error
+	// Pull streams the changes since the given state or the whole cache
+	Pull(*PullRequest, Syncer_PullServer) error
+	// Watch is the same as Pull but then keeps streaming the changes as they happen
+	Watch(*PullRequest, Syncer_WatchServer) error
+	mustEmbedUnimplementedSyncerServer()
+}
+
+// UnimplementedSyncerServer must be embedded to have forward compatible implementations.
+type UnimplementedSyncerServer struct {
+}
+
+func (UnimplementedSyncerServer) Push(Syncer_PushServer) error {
+	return status.Errorf(codes.Unimplemented, "method Push not implemented")
+}
+func (UnimplementedSyncerServer) Pull(*PullRequest, Syncer_PullServer) error {
+	return status.Errorf(codes.Unimplemented, "method Pull not implemented")
+}
+func (UnimplementedSyncerServer) Watch(*PullRequest, Syncer_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedSyncerServer) mustEmbedUnimplementedSyncerServer() {}
+
+// UnsafeSyncerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SyncerServer will
+// result in compilation errors.
+type UnsafeSyncerServer interface {
+	mustEmbedUnimplementedSyncerServer()
+}
+
+func RegisterSyncerServer(s grpc.ServiceRegistrar, srv SyncerServer) {
+	s.RegisterService(&Syncer_ServiceDesc, srv)
+}
+
+func _Syncer_Push_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(SyncerServer).Push(&syncerPushServer{stream})
+}
+
+type Syncer_PushServer interface {
+	SendAndClose(*PushResponse) error
+	Recv() (*Batch, error)
+	grpc.ServerStream
+}
+
+type syncerPushServer struct {
+	grpc.ServerStream
+}
+
+func (x *syncerPushServer) SendAndClose(m *PushResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *syncerPushServer) Recv() (*Batch, error) {
+	m := new(Batch)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Syncer_Pull_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PullRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SyncerServer).Pull(m, &syncerPullServer{stream})
+}
+
+type Syncer_PullServer interface {
+	Send(*PullResponse) error
+	grpc.ServerStream
+}
+
+type syncerPullServer struct {
+	grpc.ServerStream
+}
+
+func (x *syncerPullServer) Send(m *PullResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Syncer_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PullRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SyncerServer).Watch(m, &syncerWatchServer{stream})
+}
+
+type Syncer_WatchServer interface {
+	Send(*PullResponse) error
+	grpc.ServerStream
+}
+
+type syncerWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *syncerWatchServer) Send(m *PullResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Syncer_ServiceDesc is the grpc.ServiceDesc for Syncer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Syncer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dnstapbgp.sync.Syncer",
+	HandlerType: (*SyncerServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Push",
+			Handler:       _Syncer_Push_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Pull",
+			Handler:       _Syncer_Pull_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _Syncer_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "sync.proto",
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+type tlsCfg struct {
+	// Certificate and key to present, for clients it's needed only for the mutual auth
+	Cert string
+	Key  string
+
+	// CA to verify the other side with, the system roots are used if not set
+	CA string
+
+	// Require the clients to present a certificate signed by the CA
+	ClientAuth bool
+}
+
+func (c *tlsCfg) loadCA() (p *x509.CertPool, err error) {
+	if c.CA == "" {
+		return nil, nil
+	}
+
+	pem, err := os.ReadFile(c.CA)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA: %w", err)
+	}
+
+	p = x509.NewCertPool()
+	if !p.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file '%s'", c.CA)
+	}
+
+	return
+}
+
+func (c *tlsCfg) serverConfig() (t *tls.Config, err error) {
+	if c.Cert == "" || c.Key == "" {
+		return nil, fmt.Errorf("you need to specify TLS certificate and key")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load TLS certificate: %w", err)
+	}
+
+	t = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if !c.ClientAuth {
+		return
+	}
+
+	if t.ClientCAs, err = c.loadCA(); err != nil {
+		return nil, err
+	}
+
+	if t.ClientCAs == nil {
+		return nil, fmt.Errorf("you need to specify CA to verify client certificates")
+	}
+
+	t.ClientAuth = tls.RequireAndVerifyClientCert
+	return
+}
+
+func (c *tlsCfg) clientConfig() (t *tls.Config, err error) {
+	t = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if t.RootCAs, err = c.loadCA(); err != nil {
+		return nil, err
+	}
+
+	if c.Cert != "" && c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load TLS certificate: %w", err)
+		}
+
+		t.Certificates = []tls.Certificate{cert}
+	}
+
+	return
+}
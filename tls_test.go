@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// genCert writes a certificate signed by the parent (self-signed if it's nil) and its key into the dir
+func genCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	if parent == nil {
+		tpl.IsCA, tpl.BasicConstraintsValid = true, true
+		parent, parentKey = tpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+
+	kder, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600))
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return cert, key
+}
+
+// genTLS creates a CA with server and client certificates signed by it
+func genTLS(t *testing.T) string {
+	dir := t.TempDir()
+	ca, caKey := genCert(t, dir, "ca", nil, nil)
+	genCert(t, dir, "server", ca, caKey)
+	genCert(t, dir, "client", ca, caKey)
+	return dir
+}
+
+func Test_TLS(t *testing.T) {
+	dir := genTLS(t)
+	f := func(n string) string { return filepath.Join(dir, n) }
+
+	_, err := (&tlsCfg{}).serverConfig()
+	assert.NotNil(t, err)
+
+	_, err = (&tlsCfg{Cert: f("server.crt"), Key: f("server.key"), ClientAuth: true}).serverConfig()
+	assert.NotNil(t, err)
+
+	_, err = (&tlsCfg{CA: f("server.key")}).clientConfig()
+	assert.NotNil(t, err)
+
+	stc, err := (&tlsCfg{Cert: f("server.crt"), Key: f("server.key"), CA: f("ca.crt"), ClientAuth: true}).serverConfig()
+	assert.Nil(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = stc
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(c *tlsCfg) error {
+		ctc, err := c.clientConfig()
+		assert.Nil(t, err)
+
+		cl := &http.Client{Transport: &http.Transport{TLSClientConfig: ctc}}
+		resp, err := cl.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		return err
+	}
+
+	assert.Nil(t, get(&tlsCfg{Cert: f("client.crt"), Key: f("client.key"), CA: f("ca.crt")}))
+	// No client certificate
+	assert.NotNil(t, get(&tlsCfg{CA: f("ca.crt")}))
+	// Server is not trusted
+	assert.NotNil(t, get(&tlsCfg{Cert: f("client.crt"), Key: f("client.key")}))
+}